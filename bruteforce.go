@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 防暴力破解：校验访问密码、用户密码、API 令牌、分享密码前检查来源 IP 是否被锁定。
+// 来源 IP 取自连接地址，只有来自 TRUSTED_PROXIES 的请求才读取转发头部，见 clientIP；
+// 同一 IP 失败 authMaxFailures 次后锁定，之后每次失败锁定时间翻倍；
+// 全局每分钟失败次数超过 authGlobalMaxFailures 时暂停所有密码校验（已登录的 Cookie 会话不受影响）
+const (
+	authLockoutBase   = time.Minute     // 首次锁定时长
+	authLockoutMax    = time.Hour       // 最长锁定时长
+	authFailureTTL    = time.Hour       // 超过该时长没有再失败时清零失败次数
+	authGlobalWindow  = time.Minute     // 全局失败次数的统计周期
+	authGlobalLockout = 5 * time.Minute // 全局锁定时长
+	authMaxTracked    = 100000          // 最多记录的 IP 数
+)
+
+var (
+	authMaxFailures       = 5   // 单个 IP 连续失败多少次后锁定
+	authGlobalMaxFailures = 100 // 每分钟全局失败多少次后暂停密码校验
+
+	authGuard = &AuthGuard{ips: make(map[string]*authFailures)}
+)
+
+// authLockedError 来源 IP 或全局被锁定
+type authLockedError struct {
+	retryAfter time.Duration
+}
+
+func (e *authLockedError) Error() string {
+	return fmt.Sprintf("尝试次数过多，请 %d 秒后再试", retryAfterSeconds(e.retryAfter))
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// AuthGuard 认证失败计数
+type AuthGuard struct {
+	mu                sync.Mutex
+	ips               map[string]*authFailures
+	windowStart       time.Time
+	windowCount       int
+	globalLockedUntil time.Time
+}
+
+// check 校验凭据前调用，来源 IP 或全局被锁定时返回 *authLockedError
+func (g *AuthGuard) check(ip string) error {
+	ip = guardKey(ip)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	until := g.globalLockedUntil
+	if f := g.ips[ip]; f != nil && f.lockedUntil.After(until) {
+		until = f.lockedUntil
+	}
+	if now.Before(until) {
+		return &authLockedError{until.Sub(now)}
+	}
+	return nil
+}
+
+// record 记录一次凭据校验的结果，密码或令牌错误时计为一次失败。
+// 校验成功不清零失败次数，否则持有任一有效账号即可交替尝试其他账号的密码
+func (g *AuthGuard) record(ip string, err error) {
+	if !errors.Is(err, errUnauthorized) && !errors.Is(err, errTokenInvalid) && !errors.Is(err, errSharePassword) {
+		return
+	}
+	ip = guardKey(ip)
+	var alerts []string
+	now := time.Now()
+	g.mu.Lock()
+	f := g.ips[ip]
+	if f == nil || now.Sub(f.last) > authFailureTTL {
+		if len(g.ips) >= authMaxTracked {
+			g.pruneLocked(now)
+		}
+		f = &authFailures{}
+		g.ips[ip] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= authMaxFailures {
+		lock := min(authLockoutBase<<min(f.count-authMaxFailures, 16), authLockoutMax)
+		f.lockedUntil = now.Add(lock)
+		alerts = append(alerts, fmt.Sprintf("🚨IP %s 已认证失败 %d 次，锁定 %s", ip, f.count, lock))
+	}
+	if now.Sub(g.windowStart) > authGlobalWindow {
+		g.windowStart, g.windowCount = now, 0
+	}
+	g.windowCount++
+	if g.windowCount >= authGlobalMaxFailures && !now.Before(g.globalLockedUntil) {
+		g.globalLockedUntil = now.Add(authGlobalLockout)
+		g.windowStart, g.windowCount = now, 0
+		alerts = append(alerts, fmt.Sprintf("🚨1 分钟内认证失败超过 %d 次，已暂停所有密码校验 %s", authGlobalMaxFailures, authGlobalLockout))
+	}
+	g.mu.Unlock()
+	for _, text := range alerts {
+		log.Println(text)
+		if bot != nil {
+			go alertLockout(bot, text)
+		}
+	}
+}
+
+// guardKey 失败计数的键：IPv4 为地址本身，IPv6 按 /64 网段计数，避免轮换同一网段内的地址绕过锁定
+func guardKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Unmap().Is4() {
+		return ip
+	}
+	return netip.PrefixFrom(addr, 64).Masked().String()
+}
+
+// pruneLocked 清理已过期的失败记录，调用时需持有 g.mu
+func (g *AuthGuard) pruneLocked(now time.Time) {
+	for ip, f := range g.ips {
+		if now.Sub(f.last) > authFailureTTL && now.After(f.lockedUntil) {
+			delete(g.ips, ip)
+		}
+	}
+}
+
+// alertLockout 触发锁定时通知管理员
+func alertLockout(bot *tgbotapi.BotAPI, text string) {
+	if _, err := bot.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+		log.Println("发送锁定通知失败:", err)
+	}
+}
+
+// writeAuthError 返回认证失败的响应
+func writeAuthError(w http.ResponseWriter, err error) {
+	var locked *authLockedError
+	switch {
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(locked.retryAfter)))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, errUserDisabled):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	}
+}
+
+// secureCompare 以固定时间比较两个字符串，不泄露相同前缀的长度
+func secureCompare(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// dummyPasswordHash 用户不存在时也执行一次 bcrypt 比较，避免通过响应时间判断用户名是否存在
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("tg-disk"), bcrypt.DefaultCost)
+	return hash
+})
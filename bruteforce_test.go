@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestGuard 返回空的 AuthGuard，并临时修改失败次数上限
+func newTestGuard(t *testing.T, maxFailures, globalMax int) *AuthGuard {
+	t.Helper()
+	oldMax, oldGlobal, oldBot := authMaxFailures, authGlobalMaxFailures, bot
+	authMaxFailures, authGlobalMaxFailures, bot = maxFailures, globalMax, nil
+	t.Cleanup(func() { authMaxFailures, authGlobalMaxFailures, bot = oldMax, oldGlobal, oldBot })
+	return &AuthGuard{ips: make(map[string]*authFailures)}
+}
+
+func TestAuthGuardLockout(t *testing.T) {
+	type attempt struct {
+		ip  string
+		err error
+	}
+	fail := func(ip string, n int) []attempt {
+		list := make([]attempt, n)
+		for i := range list {
+			list[i] = attempt{ip, errUnauthorized}
+		}
+		return list
+	}
+	tests := []struct {
+		name     string
+		attempts []attempt
+		ip       string // 最后检查的 IP
+		locked   bool
+		minWait  time.Duration
+	}{
+		{"未达到上限", fail("1.1.1.1", 2), "1.1.1.1", false, 0},
+		{"达到上限后锁定", fail("1.1.1.1", 3), "1.1.1.1", true, authLockoutBase - time.Second},
+		{"超过上限后锁定时间翻倍", fail("1.1.1.1", 5), "1.1.1.1", true, 4*authLockoutBase - time.Second},
+		{"其他 IP 不受影响", fail("1.1.1.1", 3), "2.2.2.2", false, 0},
+		{"令牌错误计入失败", []attempt{{"1.1.1.1", errTokenInvalid}, {"1.1.1.1", errTokenInvalid}, {"1.1.1.1", errSharePassword}}, "1.1.1.1", true, 0},
+		{"其他错误不计入", []attempt{{"1.1.1.1", errUserDisabled}, {"1.1.1.1", errLoginExpired}, {"1.1.1.1", nil}, {"1.1.1.1", nil}}, "1.1.1.1", false, 0},
+		{"成功不清零失败次数", append(append(fail("1.1.1.1", 2), attempt{"1.1.1.1", nil}), fail("1.1.1.1", 1)...), "1.1.1.1", true, 0},
+		{"同一 /64 网段的 IPv6 共用计数", []attempt{{"2001:db8::1", errUnauthorized}, {"2001:db8::2", errUnauthorized}, {"2001:db8::3", errUnauthorized}}, "2001:db8::ffff", true, 0},
+		{"不同 /64 网段的 IPv6 分别计数", []attempt{{"2001:db8::1", errUnauthorized}, {"2001:db8:0:1::1", errUnauthorized}, {"2001:db8:0:2::1", errUnauthorized}}, "2001:db8::1", false, 0},
+		{"全局锁定", []attempt{{"1.1.1.1", errUnauthorized}, {"2.2.2.2", errUnauthorized}, {"3.3.3.3", errUnauthorized}, {"4.4.4.4", errUnauthorized}, {"5.5.5.5", errUnauthorized}}, "6.6.6.6", true, authGlobalLockout - time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGuard(t, 3, 5)
+			for _, a := range tt.attempts {
+				g.record(a.ip, a.err)
+			}
+			err := g.check(tt.ip)
+			var locked *authLockedError
+			if errors.As(err, &locked) != tt.locked {
+				t.Fatalf("check(%s) = %v, want locked %v", tt.ip, err, tt.locked)
+			}
+			if tt.locked && locked.retryAfter < tt.minWait {
+				t.Errorf("retryAfter = %s, want at least %s", locked.retryAfter, tt.minWait)
+			}
+		})
+	}
+}
+
+func TestAuthGuardLockoutCap(t *testing.T) {
+	g := newTestGuard(t, 1, 1<<30)
+	for range 40 {
+		g.record("1.1.1.1", errUnauthorized)
+	}
+	var locked *authLockedError
+	if err := g.check("1.1.1.1"); !errors.As(err, &locked) || locked.retryAfter > authLockoutMax {
+		t.Fatalf("check() = %v, want lockout capped at %s", err, authLockoutMax)
+	}
+}
+
+func TestAuthGuardFailureTTL(t *testing.T) {
+	g := newTestGuard(t, 2, 1<<30)
+	g.record("1.1.1.1", errUnauthorized)
+	g.ips["1.1.1.1"].last = time.Now().Add(-authFailureTTL - time.Minute)
+	g.record("1.1.1.1", errUnauthorized)
+	if err := g.check("1.1.1.1"); err != nil {
+		t.Fatalf("check() = %v, failures older than %s should be forgotten", err, authFailureTTL)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{"10.0.0.0/8, 172.16.0.0/12", []string{"10.0.0.0/8", "172.16.0.0/12"}, false},
+		{"192.168.1.7/24", []string{"192.168.1.0/24"}, false},
+		{"::1, fd00::/8", []string{"::1/128", "fd00::/8"}, false},
+		{"none", nil, false},
+		{"proxy.local", nil, true},
+		{"10.0.0.0/33", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTrustedProxies(tt.in)
+		if (err != nil) != tt.wantErr || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseTrustedProxies(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	old := trustedProxies
+	t.Cleanup(func() { trustedProxies = old })
+	trustedProxies, _ = parseTrustedProxies("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  []string
+		want       string
+	}{
+		{"直连", "1.2.3.4:5678", "", nil, "1.2.3.4"},
+		{"直连时忽略 X-Real-IP", "1.2.3.4:5678", "9.9.9.9", nil, "1.2.3.4"},
+		{"直连时忽略 X-Forwarded-For", "1.2.3.4:5678", "", []string{"9.9.9.9"}, "1.2.3.4"},
+		{"可信代理的 X-Real-IP", "10.0.0.2:80", "5.6.7.8", []string{"9.9.9.9"}, "5.6.7.8"},
+		{"可信代理的 X-Forwarded-For", "10.0.0.2:80", "", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"客户端伪造的前缀被跳过", "10.0.0.2:80", "", []string{"9.9.9.9, 5.6.7.8"}, "5.6.7.8"},
+		{"跳过多级可信代理", "10.0.0.2:80", "", []string{"9.9.9.9, 5.6.7.8, 10.0.0.3"}, "5.6.7.8"},
+		{"多个 X-Forwarded-For 头部", "10.0.0.2:80", "", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8"},
+		{"可信代理未带头部", "10.0.0.2:80", "", nil, "10.0.0.2"},
+		{"IPv6", "[2001:db8::1]:443", "9.9.9.9", nil, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 伪造的转发头部不能让一个客户端冒充多个 IP 触发全局锁定
+func TestAuthenticateSpoofedForwardedFor(t *testing.T) {
+	setupTest(t)
+	authGuard = newTestGuard(t, 3, 5)
+	for i := range 10 {
+		r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+		r.RemoteAddr = "1.2.3.4:5678"
+		r.Header.Set("X-Forwarded-For", fmt.Sprintf("9.9.9.%d", i))
+		r.Header.Set("X-Access-Pwd", "wrong")
+		authenticate(r)
+	}
+	if err := authGuard.check("8.8.8.8"); err != nil {
+		t.Fatalf("other clients locked out: %v", err)
+	}
+	if err := authGuard.check("1.2.3.4"); err == nil {
+		t.Fatal("attacker not locked out")
+	}
+}
+
+func TestWriteAuthError(t *testing.T) {
+	tests := []struct {
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{&authLockedError{90 * time.Second}, http.StatusTooManyRequests, "90"},
+		{&authLockedError{1500 * time.Millisecond}, http.StatusTooManyRequests, "2"},
+		{errUserDisabled, http.StatusForbidden, ""},
+		{errUnauthorized, http.StatusUnauthorized, ""},
+		{errTokenInvalid, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeAuthError(w, tt.err)
+		if w.Code != tt.status || w.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("writeAuthError(%v) = %d, Retry-After %q; want %d, %q", tt.err, w.Code, w.Header().Get("Retry-After"), tt.status, tt.retryAfter)
+		}
+	}
+}
+
+func TestSecureCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "secreT", false},
+		{"secret", "secret2", false},
+		{"", "", true},
+		{"", "x", false},
+	}
+	for _, tt := range tests {
+		if got := secureCompare(tt.a, tt.b); got != tt.want {
+			t.Errorf("secureCompare(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketFiles   = []byte("files")    // id -> FileRecord JSON
+	bucketFileIDs = []byte("file_ids") // telegram file_id -> id
+	bucketPaths   = []byte("paths")    // 虚拟路径 -> id
+	bucketFolders = []byte("folders")  // 目录路径 -> Folder JSON
+	bucketAliases = []byte("aliases")  // 重命名前的旧 file_id -> id
+	bucketHashes  = []byte("hashes")   // 内容 SHA-256 -> ChunkInfo JSON，用于去重
+	bucketShares  = []byte("shares")   // 分享 token -> ShareLink JSON
+	bucketPublic  = []byte("public")   // 公开 ID -> id
+
+	errFileNotFound = errors.New("文件不存在")
+)
+
+// FileRecord 记录一次上传的完整信息
+type FileRecord struct {
+	ID         string      `json:"id"`
+	PublicID   string      `json:"public_id"` // 下载链接 /f/{public_id} 使用的短 ID，file_id 变化后保持不变
+	Filename   string      `json:"filename"`
+	Path       string      `json:"path"`
+	Size       int64       `json:"size"`
+	MimeType   string      `json:"mime_type"`
+	SHA256     string      `json:"sha256,omitempty"`
+	FileID     string      `json:"file_id"`
+	MessageID  int         `json:"message_id"`
+	Chunked    bool        `json:"chunked"`
+	Chunks     []ChunkInfo `json:"chunks,omitempty"`
+	UploadedAt time.Time   `json:"uploaded_at"`
+	Uploader   string      `json:"uploader"`             // 上传者，见 User.actor
+	Visibility Visibility  `json:"visibility,omitempty"` // 为空时使用 DEFAULT_VISIBILITY
+}
+
+// ChunkInfo 大文件的单个分块
+type ChunkInfo struct {
+	FileID    string `json:"file_id"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256,omitempty"`
+	MessageID int    `json:"message_id,omitempty"`
+	// 加密分块的密钥 ID 及 nonce；Size、SHA256 均为明文的大小和哈希
+	KeyID string `json:"key_id,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	// 压缩分块的算法及在 Telegram 上实际存储的字节数
+	Compression string `json:"compression,omitempty"`
+	StoredSize  int64  `json:"stored_size,omitempty"`
+}
+
+// Catalog 基于 bbolt 的本地文件目录，记录所有上传到 Telegram 的文件
+type Catalog struct {
+	db *bolt.DB
+}
+
+func openCatalog(path string) (*Catalog, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketFiles, bucketFileIDs, bucketPaths, bucketFolders, bucketAliases, bucketHashes, bucketShares, bucketPublic, bucketUsers, bucketTokens, bucketLogins} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if err := reindexPathsTx(tx); err != nil {
+			return err
+		}
+		if err := reindexPublicIDsTx(tx); err != nil {
+			return err
+		}
+		return reindexHashesTx(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Catalog{db: db}, nil
+}
+
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// PutFile 新增或更新一条文件记录，ID 为空时自动生成
+func (c *Catalog) PutFile(rec *FileRecord) error {
+	if rec.ID == "" {
+		rec.ID = newID()
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return putFileTx(tx, rec)
+	})
+}
+
+func putFileTx(tx *bolt.Tx, rec *FileRecord) error {
+	rec.Path = cleanPath(rec.Path)
+	fullPath := rec.FullPath()
+	paths := tx.Bucket(bucketPaths)
+	if ref := paths.Get([]byte(fullPath)); ref != nil && string(ref) != rec.ID {
+		return errPathExists
+	}
+	if old := tx.Bucket(bucketFiles).Get([]byte(rec.ID)); old != nil {
+		oldRec := &FileRecord{}
+		if err := json.Unmarshal(old, oldRec); err != nil {
+			return err
+		}
+		if oldPath := oldRec.FullPath(); oldPath != fullPath {
+			if err := paths.Delete([]byte(oldPath)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ensureFolderTx(tx, rec.Path); err != nil {
+		return err
+	}
+	if err := assignPublicIDTx(tx, rec); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketFiles).Put([]byte(rec.ID), data); err != nil {
+		return err
+	}
+	if err := paths.Put([]byte(fullPath), []byte(rec.ID)); err != nil {
+		return err
+	}
+	if rec.FileID != "" {
+		return tx.Bucket(bucketFileIDs).Put([]byte(rec.FileID), []byte(rec.ID))
+	}
+	return nil
+}
+
+// reindexPathsTx 为旧版本写入的、没有路径索引的记录补建索引（放在根目录）
+func reindexPathsTx(tx *bolt.Tx) error {
+	var legacy []*FileRecord
+	err := tx.Bucket(bucketFiles).ForEach(func(_, v []byte) error {
+		rec := &FileRecord{}
+		if err := json.Unmarshal(v, rec); err != nil {
+			return err
+		}
+		if rec.Path == "" {
+			legacy = append(legacy, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, rec := range legacy {
+		rec.Path = "/"
+		err := putFileTx(tx, rec)
+		if errors.Is(err, errPathExists) {
+			// 同名文件只保留第一个的路径索引，其余仍可通过 ID 访问
+			data, _ := json.Marshal(rec)
+			err = tx.Bucket(bucketFiles).Put([]byte(rec.ID), data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexHashesTx 去重索引为空时（首次升级），根据已有记录中的 SHA-256 补建
+func reindexHashesTx(tx *bolt.Tx) error {
+	hashes := tx.Bucket(bucketHashes)
+	if k, _ := hashes.Cursor().First(); k != nil {
+		return nil
+	}
+	return tx.Bucket(bucketFiles).ForEach(func(_, v []byte) error {
+		rec := &FileRecord{}
+		if err := json.Unmarshal(v, rec); err != nil {
+			return err
+		}
+		blobs := rec.Chunks
+		if !rec.Chunked {
+			blobs = []ChunkInfo{{FileID: rec.FileID, Size: rec.Size, SHA256: rec.SHA256, MessageID: rec.MessageID}}
+		}
+		for _, c := range blobs {
+			if err := putBlobTx(tx, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func putBlobTx(tx *bolt.Tx, c ChunkInfo) error {
+	if c.SHA256 == "" || c.FileID == "" {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketHashes).Put([]byte(c.SHA256), data)
+}
+
+// PutBlob 记录已发送到 Telegram 的内容，相同 SHA-256 的内容以后可以直接复用
+func (c *Catalog) PutBlob(blob ChunkInfo) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return putBlobTx(tx, blob)
+	})
+}
+
+// LookupBlob 按 SHA-256 查找已发送过的相同内容
+func (c *Catalog) LookupBlob(sha string) (ChunkInfo, bool) {
+	var blob ChunkInfo
+	var found bool
+	c.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucketHashes).Get([]byte(sha)); data != nil {
+			found = json.Unmarshal(data, &blob) == nil
+		}
+		return nil
+	})
+	return blob, found
+}
+
+// ForgetBlob 消息被删除后，移除指向该 file_id 的去重索引
+func (c *Catalog) ForgetBlob(fileID string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		hashes := tx.Bucket(bucketHashes)
+		var keys [][]byte
+		err := hashes.ForEach(func(k, v []byte) error {
+			var blob ChunkInfo
+			if json.Unmarshal(v, &blob) == nil && blob.FileID == fileID {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := hashes.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetFile 按记录 ID 或 Telegram file_id（包括重命名前的旧 file_id）查询文件
+func (c *Catalog) GetFile(id string) (*FileRecord, error) {
+	var rec *FileRecord
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketFiles).Get([]byte(id))
+		if data == nil {
+			if ref := tx.Bucket(bucketFileIDs).Get([]byte(id)); ref != nil {
+				data = tx.Bucket(bucketFiles).Get(ref)
+			} else if ref := tx.Bucket(bucketAliases).Get([]byte(id)); ref != nil {
+				data = tx.Bucket(bucketFiles).Get(ref)
+			}
+		}
+		if data == nil {
+			return errFileNotFound
+		}
+		rec = &FileRecord{}
+		return json.Unmarshal(data, rec)
+	})
+	return rec, err
+}
+
+// FilesByFileID 按 file_id 查询下载内容对应的文件记录：去重（秒传）后多条记录可能共用同一个 file_id，全部返回；
+// 没有记录直接使用该 file_id 时按记录 ID、重命名前的旧 file_id 查询。不在文件目录中时返回空
+func (c *Catalog) FilesByFileID(fileID string) ([]*FileRecord, error) {
+	var list []*FileRecord
+	err := c.db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		if tx.Bucket(bucketFileIDs).Get([]byte(fileID)) != nil {
+			return files.ForEach(func(_, v []byte) error {
+				rec := &FileRecord{}
+				if err := json.Unmarshal(v, rec); err != nil {
+					return err
+				}
+				if rec.FileID == fileID {
+					list = append(list, rec)
+				}
+				return nil
+			})
+		}
+		data := files.Get([]byte(fileID))
+		if ref := tx.Bucket(bucketAliases).Get([]byte(fileID)); data == nil && ref != nil {
+			data = files.Get(ref)
+		}
+		if data == nil {
+			return nil
+		}
+		rec := &FileRecord{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return err
+		}
+		list = append(list, rec)
+		return nil
+	})
+	return list, err
+}
+
+// RenameFile 更新文件名；fileID 与原来不同时（分块文件重新发送了清单），
+// 原 file_id 记为别名，旧链接仍能找到该文件
+func (c *Catalog) RenameFile(id, name, fileID string, messageID int) (*FileRecord, error) {
+	var rec *FileRecord
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketFiles).Get([]byte(id))
+		if data == nil {
+			return errFileNotFound
+		}
+		rec = &FileRecord{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return err
+		}
+		oldFileID := rec.FileID
+		rec.Filename, rec.MimeType = name, mimeTypeOf(name)
+		rec.FileID, rec.MessageID = fileID, messageID
+		if err := putFileTx(tx, rec); err != nil {
+			return err
+		}
+		if oldFileID != fileID {
+			if err := tx.Bucket(bucketFileIDs).Delete([]byte(oldFileID)); err != nil {
+				return err
+			}
+			return tx.Bucket(bucketAliases).Put([]byte(oldFileID), []byte(rec.ID))
+		}
+		return nil
+	})
+	return rec, err
+}
+
+// DeleteFile 删除文件记录及其 file_id、路径、别名、公开 ID 索引和分享链接
+func (c *Catalog) DeleteFile(id string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(bucketFiles)
+		data := files.Get([]byte(id))
+		if data == nil {
+			return errFileNotFound
+		}
+		rec := &FileRecord{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return err
+		}
+		if ref := tx.Bucket(bucketFileIDs).Get([]byte(rec.FileID)); string(ref) == rec.ID {
+			// 去重后多条记录可能共用同一个 file_id，索引改为指向其中另一条
+			var other []byte
+			files.ForEach(func(k, v []byte) error {
+				o := &FileRecord{}
+				if other == nil && string(k) != rec.ID && json.Unmarshal(v, o) == nil && o.FileID == rec.FileID {
+					other = append([]byte(nil), k...)
+				}
+				return nil
+			})
+			var err error
+			if other != nil {
+				err = tx.Bucket(bucketFileIDs).Put([]byte(rec.FileID), other)
+			} else {
+				err = tx.Bucket(bucketFileIDs).Delete([]byte(rec.FileID))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if ref := tx.Bucket(bucketPaths).Get([]byte(rec.FullPath())); string(ref) == rec.ID {
+			if err := tx.Bucket(bucketPaths).Delete([]byte(rec.FullPath())); err != nil {
+				return err
+			}
+		}
+		var aliases [][]byte
+		tx.Bucket(bucketAliases).ForEach(func(k, v []byte) error {
+			if string(v) == rec.ID {
+				aliases = append(aliases, k)
+			}
+			return nil
+		})
+		for _, k := range aliases {
+			if err := tx.Bucket(bucketAliases).Delete(k); err != nil {
+				return err
+			}
+		}
+		if err := deleteSharesTx(tx, rec.ID); err != nil {
+			return err
+		}
+		if rec.PublicID != "" {
+			if err := tx.Bucket(bucketPublic).Delete([]byte(rec.PublicID)); err != nil {
+				return err
+			}
+		}
+		return files.Delete([]byte(rec.ID))
+	})
+}
+
+// ListFiles 返回全部文件记录，按上传时间倒序
+func (c *Catalog) ListFiles() ([]*FileRecord, error) {
+	var list []*FileRecord
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFiles).ForEach(func(_, v []byte) error {
+			rec := &FileRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			list = append(list, rec)
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UploadedAt.After(list[j].UploadedAt)
+	})
+	return list, err
+}
+
+// recordUpload 将上传结果写入目录，目标路径已被占用时返回 errPathExists
+func recordUpload(rec *FileRecord) error {
+	if rec.UploadedAt.IsZero() {
+		rec.UploadedAt = time.Now()
+	}
+	if err := catalog.PutFile(rec); err != nil {
+		log.Printf("写入文件目录失败 [%s]: %v", rec.Filename, err)
+		return err
+	}
+	return nil
+}
+
+// sameContent 文件内容的 SHA-256 是否为 sha（分块文件只比较仅有一个分块的情况）
+func (rec *FileRecord) sameContent(sha string) bool {
+	if rec.Chunked {
+		return len(rec.Chunks) == 1 && rec.Chunks[0].SHA256 == sha
+	}
+	return rec.SHA256 == sha
+}
+
+// handleListFiles GET /api/files，非管理员只列出自己目录下的文件
+func handleListFiles(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permRead)
+	if !ok {
+		return
+	}
+	list, err := catalog.ListFiles()
+	if err != nil {
+		http.Error(w, "读取文件目录失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	visible := []*FileRecord{}
+	for _, rec := range list {
+		if u.owns(rec) {
+			visible = append(visible, u.viewFile(rec))
+		}
+	}
+	writeJSON(w, visible)
+}
+
+// handleGetFile GET /api/files/{id}，id 可以是记录 ID 或 file_id
+func handleGetFile(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permRead)
+	if !ok {
+		return
+	}
+	rec, err := getUserFile(u, r.PathValue("id"))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, u.viewFile(rec))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// trustedProxies 可信的反向代理地址（TRUSTED_PROXIES），只有来自这些地址的请求才读取 X-Real-IP、X-Forwarded-For。
+// 默认为本机及内网地址，覆盖同机部署及 Docker 端口映射（连接来自网桥网关）的情况
+var trustedProxies, _ = parseTrustedProxies(defaultTrustedProxies)
+
+const defaultTrustedProxies = "127.0.0.0/8,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+// parseTrustedProxies 解析逗号分隔的 IP 或 CIDR，"none" 表示不信任任何代理
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var list []netip.Prefix
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || item == "none" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("无效的代理地址: %s", item)
+			}
+			list = append(list, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的代理地址: %s", item)
+		}
+		list = append(list, prefix.Masked())
+	}
+	return list, nil
+}
+
+// isTrustedProxy ip 是否为可信的反向代理
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP 获取客户端 IP。请求来自可信的反向代理时优先使用 X-Real-IP，
+// 其次从右向左取 X-Forwarded-For 中第一个不是可信代理的地址；其他请求的这两个头部可以伪造，直接忽略
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		hops := strings.Split(strings.Join(fwd, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			if ip := strings.TrimSpace(hops[i]); ip != "" && !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+	}
+	return host
+}
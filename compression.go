@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 透明压缩（可选）：文本、JSON、源码包等可压缩的文件按分块压缩后再发送（开启加密时先压缩再加密），
+// 压缩后节省不到 10% 的分块仍按原样发送。每个分块记录自己的压缩算法，下载时整块解压后再截取区间，
+// 因此 Content-Length 和 Range 始终按解压后的大小计算
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	// minCompressionRatio 压缩后不大于原大小的该比例才保存压缩结果
+	minCompressionRatio = 0.9
+)
+
+var (
+	compressionAlg string // COMPRESSION 配置的算法，为空表示不压缩
+
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxChunkSize))
+)
+
+// setCompression 解析 COMPRESSION：gzip、zstd，空或 off 表示关闭
+func setCompression(alg string) error {
+	switch alg = strings.ToLower(strings.TrimSpace(alg)); alg {
+	case "", "off":
+		compressionAlg = ""
+	case compressionGzip, compressionZstd:
+		compressionAlg = alg
+	default:
+		return fmt.Errorf("不支持的压缩算法: %s", alg)
+	}
+	return nil
+}
+
+// compressibleType 判断 MIME 类型的内容是否值得压缩
+func compressibleType(contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	if strings.HasPrefix(contentType, "text/") ||
+		strings.HasSuffix(contentType, "+json") || strings.HasSuffix(contentType, "+xml") {
+		return true
+	}
+	switch contentType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/x-ndjson", "application/x-yaml", "application/yaml", "application/toml",
+		"application/sql", "application/x-sh", "application/x-tar", "application/wasm":
+		return true
+	}
+	return false
+}
+
+// compressionFor 根据文件名的 MIME 类型决定分块是否压缩，扩展名无法判断时嗅探分块开头的内容
+func compressionFor(filename, chunkPath string) string {
+	if compressionAlg == "" {
+		return ""
+	}
+	contentType := mimeTypeOf(filename)
+	if contentType == "application/octet-stream" {
+		f, err := os.Open(chunkPath)
+		if err != nil {
+			return ""
+		}
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		f.Close()
+		contentType = http.DetectContentType(head[:n])
+	}
+	if !compressibleType(contentType) {
+		return ""
+	}
+	return compressionAlg
+}
+
+// compressFile 使用 alg 压缩 src 写入 dst，压缩率达不到 minCompressionRatio 时返回 false
+func compressFile(src, dst, alg string) (bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+
+	var w io.WriteCloser
+	switch alg {
+	case compressionGzip:
+		w = gzip.NewWriter(out)
+	case compressionZstd:
+		if w, err = zstd.NewWriter(out); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("不支持的压缩算法: %s", alg)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	compressed, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	return float64(compressed) <= float64(stat.Size())*minCompressionRatio, nil
+}
+
+// decompressChunk 解压一个完整的分块，解压结果必须正好是 size 字节
+func decompressChunk(alg string, data []byte, size int64) ([]byte, error) {
+	var plain []byte
+	var err error
+	switch alg {
+	case compressionGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			plain, err = io.ReadAll(io.LimitReader(r, size+1))
+		}
+	case compressionZstd:
+		plain, err = zstdDecoder.DecodeAll(data, make([]byte, 0, size))
+	default:
+		return nil, fmt.Errorf("不支持的压缩算法: %s", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解压失败: %w", err)
+	}
+	if int64(len(plain)) != size {
+		return nil, fmt.Errorf("解压后大小不一致: %d/%d 字节", len(plain), size)
+	}
+	return plain, nil
+}
+
+// decodeChunk 将 Telegram 上存储的分块还原为原始内容：先解密，再解压
+func decodeChunk(c ChunkInfo, data []byte) ([]byte, error) {
+	var err error
+	if c.KeyID != "" {
+		if data, err = decryptChunk(c.KeyID, c.Nonce, data); err != nil {
+			return nil, err
+		}
+	}
+	if c.Compression != "" {
+		return decompressChunk(c.Compression, data, c.Size)
+	}
+	return data, nil
+}
+
+// encodedChunk 分块在 Telegram 上是否经过压缩或加密，需要下载整块后还原
+func encodedChunk(c ChunkInfo) bool {
+	return c.KeyID != "" || c.Compression != ""
+}
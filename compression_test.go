@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 直接上传的明文文件不复用压缩过的分块，否则下载到的是压缩后的数据
+func TestDedupMatchesEncoding(t *testing.T) {
+	data := strings.Repeat("tg-disk dedup ", 1000)
+	upload := func(t *testing.T, filename string) {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", filename)
+		fw.Write([]byte(data))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("X-Access-Pwd", "secret")
+		w := serve(http.HandlerFunc(handleUpload), r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload %s: status %d: %s", filename, w.Code, w.Body)
+		}
+	}
+	tests := []struct {
+		name   string
+		first  string // 第一次上传时的压缩算法
+		second string // 第二次上传时的压缩算法
+	}{
+		{"先压缩后明文", compressionGzip, ""},
+		{"先明文后压缩", "", compressionZstd},
+		{"都压缩", compressionZstd, compressionGzip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			oldAlg := compressionAlg
+			t.Cleanup(func() { compressionAlg = oldAlg })
+
+			compressionAlg = tt.first
+			upload(t, "a.txt")
+			compressionAlg = tt.second
+			upload(t, "b.txt")
+			for _, p := range []string{"/a.txt", "/b.txt"} {
+				r := httptest.NewRequest(http.MethodGet, "/d?path="+p, nil)
+				r.Header.Set("X-Access-Pwd", "secret")
+				if w := serve(http.HandlerFunc(handleDownload), r); w.Code != http.StatusOK || w.Body.String() != data {
+					t.Errorf("download %s: status %d, %d bytes; want %d bytes", p, w.Code, w.Body.Len(), len(data))
+				}
+			}
+		})
+	}
+}
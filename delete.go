@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// DeleteFailure 删除失败的消息
+type DeleteFailure struct {
+	FileID    string `json:"file_id"`
+	MessageID int    `json:"message_id,omitempty"`
+	Error     string `json:"error"`
+}
+
+// DeleteReport 删除文件的结果，Failed 非空表示部分消息未能删除，需要到 Telegram 中手动处理
+type DeleteReport struct {
+	ID       string          `json:"id,omitempty"`
+	FileID   string          `json:"file_id"`
+	Filename string          `json:"filename"`
+	Deleted  int             `json:"deleted"`
+	Shared   int             `json:"shared"` // 与其他文件共用（去重）而保留的消息数
+	Failed   []DeleteFailure `json:"failed"`
+	Complete bool            `json:"complete"`
+}
+
+// deleteFile 删除文件的所有分块消息及清单消息（单文件只有一条消息），再从文件目录中移除。
+// 仍被其他文件或上传会话引用的消息会保留；如果一条消息都没删掉，则保留目录记录以便重试
+func deleteFile(rec *FileRecord) (*DeleteReport, error) {
+	report := &DeleteReport{ID: rec.ID, FileID: rec.FileID, Filename: rec.Filename, Failed: []DeleteFailure{}}
+	refs, err := collectBlobRefs(rec.ID, time.Time{})
+	if err != nil {
+		return report, fmt.Errorf("读取文件目录失败: %w", err)
+	}
+	attempt := func(c ChunkInfo) {
+		if refs.has(c) {
+			report.Shared++
+			return
+		}
+		if err := deleteBlob(c); err != nil {
+			report.Failed = append(report.Failed, DeleteFailure{FileID: c.FileID, MessageID: c.MessageID, Error: err.Error()})
+			return
+		}
+		report.Deleted++
+	}
+	if rec.Chunked {
+		for _, c := range rec.Chunks {
+			attempt(c)
+		}
+	}
+	attempt(ChunkInfo{FileID: rec.FileID, MessageID: rec.MessageID})
+	report.Complete = len(report.Failed) == 0
+
+	if report.Deleted == 0 && len(report.Failed) > 0 {
+		return report, errors.New("删除 Telegram 消息失败: " + report.Failed[len(report.Failed)-1].Error)
+	}
+	if rec.ID != "" {
+		if err := catalog.DeleteFile(rec.ID); err != nil && !errors.Is(err, errFileNotFound) {
+			return report, fmt.Errorf("更新文件目录失败: %w", err)
+		}
+	}
+	log.Printf("删除文件 %s (%s)：删除消息 %d 条，共用保留 %d 条，失败 %d 条",
+		rec.Filename, rec.FileID, report.Deleted, report.Shared, len(report.Failed))
+	return report, nil
+}
+
+// handleDeleteFile DELETE /api/files/{id}
+func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permDelete)
+	if !ok {
+		return
+	}
+	rec, err := getUserFile(u, r.PathValue("id"))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	report, err := deleteFile(rec)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		writeJSON(w, report)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// handleDeleteCommand 机器人命令：回复文件消息 /delete 删除该文件（分块文件回复清单消息）
+func handleDeleteCommand(msg *tgbotapi.Message) {
+	reply := func(text string) {
+		if _, err := bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text)); err != nil {
+			log.Println(err)
+		}
+	}
+	fileID, fileName := replyFile(msg.ReplyToMessage)
+	if fileID == "" {
+		reply("无法获取文件ID")
+		return
+	}
+
+	rec, err := catalog.GetFile(fileID)
+	if err != nil {
+		// 不在文件目录中（如旧版本上传的文件），只能删除回复的这条消息；清单中的分块没有记录消息 ID，会作为失败项列出。
+		// 消息 ID 只在 CHAT_ID 中有效，在与其他用户的对话中回复时不删除消息
+		rec = &FileRecord{Filename: fileName, FileID: fileID}
+		if msg.Chat.ID == chatID {
+			rec.MessageID = msg.ReplyToMessage.MessageID
+		}
+		if isManifestName(fileName) {
+			m, err := fetchManifest(context.Background(), fileID)
+			if err != nil {
+				reply("读取清单失败: " + err.Error())
+				return
+			}
+			rec.Filename, rec.Chunked, rec.Chunks = m.Filename, true, m.Chunks
+		}
+	}
+
+	report, err := deleteFile(rec)
+	if err != nil {
+		reply(fmt.Sprintf("删除文件 [%s] 失败: %v", rec.Filename, err))
+		return
+	}
+	text := fmt.Sprintf("🗑文件 [%s] 已删除\n\n删除消息：%d 条", rec.Filename, report.Deleted)
+	if report.Shared > 0 {
+		text += fmt.Sprintf("\n与其他文件共用而保留：%d 条", report.Shared)
+	}
+	if len(report.Failed) > 0 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "\n失败：%d 条，请手动删除：", len(report.Failed))
+		for _, f := range report.Failed {
+			fmt.Fprintf(&b, "\n%s (消息 %d): %s", f.FileID, f.MessageID, f.Error)
+		}
+		text += b.String()
+	}
+	reply(text)
+}
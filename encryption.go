@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 分块静态加密（可选）：每个分块使用 AES-256-GCM 加密后再发送到 Telegram。
+// 分块密钥由主密钥经 HKDF-SHA256 派生（salt 为该分块随机生成的 96 位 nonce），
+// 密钥 ID 与 nonce 记录在清单的分块信息中，解密时按密钥 ID 找到对应的主密钥，因此可以轮换主密钥：
+// 把新密钥放在 ENCRYPTION_KEYS 的第一个用于加密，旧密钥留在后面继续用于解密。
+const (
+	encryptionScheme   = "aes-256-gcm+hkdf-sha256"
+	encryptionOverhead = 16 // GCM 认证标签长度，密文比明文多出的字节数
+	chunkKeyInfo       = "tg-disk chunk v1"
+)
+
+var errUnknownKey = errors.New("未配置密钥")
+
+var (
+	encryptionKeys  = map[string][]byte{} // 密钥 ID -> 32 字节主密钥
+	encryptionKeyID string                // 当前用于加密的密钥 ID，为空表示不加密
+)
+
+// loadEncryptionKeys 解析 ENCRYPTION_KEYS：逗号分隔的 "密钥ID:base64(32字节主密钥)"，第一个为当前密钥
+func loadEncryptionKeys(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(item, ":")
+		if !ok || id == "" {
+			return fmt.Errorf("密钥格式错误，应为 id:base64: %q", item)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("密钥 %s 必须是 base64 编码的 32 字节", id)
+		}
+		if _, dup := encryptionKeys[id]; dup {
+			return fmt.Errorf("密钥 ID 重复: %s", id)
+		}
+		encryptionKeys[id] = key
+		if encryptionKeyID == "" {
+			encryptionKeyID = id
+		}
+	}
+	return nil
+}
+
+func encryptionEnabled() bool {
+	return encryptionKeyID != ""
+}
+
+// chunkAEAD 由主密钥和 nonce 派生分块密钥
+func chunkAEAD(keyID string, nonce []byte) (cipher.AEAD, error) {
+	master, ok := encryptionKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errUnknownKey, keyID)
+	}
+	key, err := hkdf.Key(sha256.New, master, nonce, chunkKeyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealBytes 使用当前密钥加密 plain，aad 为附加认证数据，返回密钥 ID、nonce（hex）和密文
+func sealBytes(plain, aad []byte) (keyID, nonce string, sealed []byte, err error) {
+	n := make([]byte, 12)
+	if _, err := rand.Read(n); err != nil {
+		return "", "", nil, err
+	}
+	aead, err := chunkAEAD(encryptionKeyID, n)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return encryptionKeyID, hex.EncodeToString(n), aead.Seal(nil, n, plain, aad), nil
+}
+
+// openBytes 解密 sealBytes 的结果，认证失败说明密文被篡改或密钥错误
+func openBytes(keyID, nonce string, data, aad []byte) ([]byte, error) {
+	n, err := hex.DecodeString(nonce)
+	if err != nil || len(n) != 12 {
+		return nil, errors.New("nonce 格式错误")
+	}
+	aead, err := chunkAEAD(keyID, n)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(data[:0], n, data, aad)
+	if err != nil {
+		return nil, fmt.Errorf("解密失败（密钥 %s）: %w", keyID, err)
+	}
+	return plain, nil
+}
+
+// encryptFile 使用当前密钥加密 src 写入 dst，返回密钥 ID 和 nonce（hex）
+func encryptFile(src, dst string) (keyID, nonce string, err error) {
+	plain, err := os.ReadFile(src)
+	if err != nil {
+		return "", "", err
+	}
+	keyID, nonce, sealed, err := sealBytes(plain, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(dst, sealed, 0600); err != nil {
+		return "", "", err
+	}
+	return keyID, nonce, nil
+}
+
+// decryptChunk 解密一个完整的分块
+func decryptChunk(keyID, nonce string, data []byte) ([]byte, error) {
+	return openBytes(keyID, nonce, data, nil)
+}
+
+// checkChunkKeys 确认所有加密分块的密钥都已配置，避免下载到一半才失败
+func checkChunkKeys(chunks []ChunkInfo) error {
+	for _, c := range chunks {
+		if _, ok := encryptionKeys[c.KeyID]; c.KeyID != "" && !ok {
+			return fmt.Errorf("%w %s", errUnknownKey, c.KeyID)
+		}
+	}
+	return nil
+}
+
+// uploadChunkSize 默认的上传分片大小，开启加密时扣除密文多出的字节，保证密文不超过分片上限
+func uploadChunkSize() int64 {
+	size := int64(frontendChunkSize) << 20
+	if encryptionEnabled() {
+		size -= encryptionOverhead
+	}
+	return size
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	errFolderNotFound = errors.New("目录不存在")
+	errFolderNotEmpty = errors.New("目录不为空")
+	errPathExists     = errors.New("目标路径已存在")
+	errInvalidPath    = errors.New("路径不合法")
+)
+
+// Folder 虚拟目录
+type Folder struct {
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FolderListing 目录下的直接子目录和文件
+type FolderListing struct {
+	Path    string        `json:"path"`
+	Folders []*Folder     `json:"folders"`
+	Files   []*FileRecord `json:"files"`
+}
+
+// cleanPath 规范化虚拟路径，始终以 / 开头且不以 / 结尾（根目录除外）
+func cleanPath(p string) string {
+	return path.Clean("/" + strings.TrimSpace(p))
+}
+
+// FullPath 返回文件的完整虚拟路径
+func (rec *FileRecord) FullPath() string {
+	return path.Join(cleanPath(rec.Path), rec.Filename)
+}
+
+// isUnder 判断 p 是否为 dir 本身或其子路径
+func isUnder(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// ensureFolderTx 创建目录及其所有上级目录（已存在则忽略）
+func ensureFolderTx(tx *bolt.Tx, dir string) error {
+	folders := tx.Bucket(bucketFolders)
+	for dir = cleanPath(dir); dir != "/"; dir = path.Dir(dir) {
+		if tx.Bucket(bucketPaths).Get([]byte(dir)) != nil {
+			return errPathExists
+		}
+		if folders.Get([]byte(dir)) != nil {
+			continue
+		}
+		data, err := json.Marshal(&Folder{Path: dir, CreatedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		if err := folders.Put([]byte(dir), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func folderExistsTx(tx *bolt.Tx, dir string) bool {
+	return dir == "/" || tx.Bucket(bucketFolders).Get([]byte(dir)) != nil
+}
+
+// CreateFolder 创建目录，上级目录不存在时一并创建
+func (c *Catalog) CreateFolder(dir string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return ensureFolderTx(tx, dir)
+	})
+}
+
+// FolderExists 判断目录是否存在
+func (c *Catalog) FolderExists(dir string) bool {
+	exists := false
+	c.db.View(func(tx *bolt.Tx) error {
+		exists = folderExistsTx(tx, cleanPath(dir))
+		return nil
+	})
+	return exists
+}
+
+// GetFileByPath 按完整虚拟路径查询文件
+func (c *Catalog) GetFileByPath(p string) (*FileRecord, error) {
+	var id string
+	c.db.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(bucketPaths).Get([]byte(cleanPath(p))))
+		return nil
+	})
+	if id == "" {
+		return nil, errFileNotFound
+	}
+	return c.GetFile(id)
+}
+
+// PathExists 判断完整虚拟路径上是否已有文件
+func (c *Catalog) PathExists(p string) bool {
+	_, err := c.GetFileByPath(p)
+	return err == nil
+}
+
+// MoveFolder 将目录 src 移动/重命名为 dst，所有子目录和文件随之更新
+func (c *Catalog) MoveFolder(src, dst string) error {
+	src, dst = cleanPath(src), cleanPath(dst)
+	if src == "/" || isUnder(dst, src) {
+		return errInvalidPath
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if !folderExistsTx(tx, src) {
+			return errFolderNotFound
+		}
+		if folderExistsTx(tx, dst) || tx.Bucket(bucketPaths).Get([]byte(dst)) != nil {
+			return errPathExists
+		}
+		if err := ensureFolderTx(tx, path.Dir(dst)); err != nil {
+			return err
+		}
+		rebase := func(p string) string {
+			return dst + strings.TrimPrefix(p, src)
+		}
+
+		// 先收集，再修改（bbolt 遍历时不能修改 bucket）
+		var folders []*Folder
+		var files []*FileRecord
+		err := tx.Bucket(bucketFolders).ForEach(func(_, v []byte) error {
+			f := &Folder{}
+			if err := json.Unmarshal(v, f); err != nil {
+				return err
+			}
+			if isUnder(f.Path, src) {
+				folders = append(folders, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(bucketFiles).ForEach(func(_, v []byte) error {
+			rec := &FileRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if isUnder(cleanPath(rec.Path), src) {
+				files = append(files, rec)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, f := range folders {
+			if err := tx.Bucket(bucketFolders).Delete([]byte(f.Path)); err != nil {
+				return err
+			}
+			f.Path = rebase(f.Path)
+			data, err := json.Marshal(f)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketFolders).Put([]byte(f.Path), data); err != nil {
+				return err
+			}
+		}
+		for _, rec := range files {
+			rec.Path = rebase(cleanPath(rec.Path))
+			if err := putFileTx(tx, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteFolder 删除空目录
+func (c *Catalog) DeleteFolder(dir string) error {
+	dir = cleanPath(dir)
+	if dir == "/" {
+		return errInvalidPath
+	}
+	listing, err := c.ListFolder(dir)
+	if err != nil {
+		return err
+	}
+	if len(listing.Folders) > 0 || len(listing.Files) > 0 {
+		return errFolderNotEmpty
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFolders).Delete([]byte(dir))
+	})
+}
+
+// ListFolder 列出目录下的直接子目录和文件
+func (c *Catalog) ListFolder(dir string) (*FolderListing, error) {
+	dir = cleanPath(dir)
+	listing := &FolderListing{Path: dir, Folders: []*Folder{}, Files: []*FileRecord{}}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if !folderExistsTx(tx, dir) {
+			return errFolderNotFound
+		}
+		err := tx.Bucket(bucketFolders).ForEach(func(_, v []byte) error {
+			f := &Folder{}
+			if err := json.Unmarshal(v, f); err != nil {
+				return err
+			}
+			if path.Dir(f.Path) == dir {
+				listing.Folders = append(listing.Folders, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketFiles).ForEach(func(_, v []byte) error {
+			rec := &FileRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if cleanPath(rec.Path) == dir {
+				listing.Files = append(listing.Files, rec)
+			}
+			return nil
+		})
+	})
+	sort.Slice(listing.Folders, func(i, j int) bool {
+		return listing.Folders[i].Path < listing.Folders[j].Path
+	})
+	sort.Slice(listing.Files, func(i, j int) bool {
+		return listing.Files[i].Filename < listing.Files[j].Filename
+	})
+	return listing, err
+}
+
+// MoveFile 将文件移动到目录 dir
+func (c *Catalog) MoveFile(id, dir string) (*FileRecord, error) {
+	rec, err := c.GetFile(id)
+	if err != nil {
+		return nil, err
+	}
+	rec.Path = dir
+	return rec, c.PutFile(rec)
+}
+
+// writeCatalogError 将目录操作错误映射为对应的 HTTP 状态码
+func writeCatalogError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errFileNotFound), errors.Is(err, errFolderNotFound), errors.Is(err, errUserNotFound),
+		errors.Is(err, errTokenNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errPathExists), errors.Is(err, errFolderNotEmpty), errors.Is(err, errUserExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInvalidPath):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "操作文件目录失败: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// validName 校验文件/目录名，不能为空或包含路径分隔符
+func validName(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// handleListFolder GET /api/folders?path=，非管理员的路径相对于自己的目录
+func handleListFolder(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permRead)
+	if !ok {
+		return
+	}
+	dir := u.abs(r.FormValue("path"))
+	listing, err := catalog.ListFolder(dir)
+	if errors.Is(err, errFolderNotFound) && dir == u.root() {
+		// 个人目录被删除后视为空目录，上传时会重新创建
+		listing, err = &FolderListing{Path: dir, Folders: []*Folder{}, Files: []*FileRecord{}}, nil
+	}
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, u.viewListing(listing))
+}
+
+// handleCreateFolder POST /api/folders，参数 path
+func handleCreateFolder(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	dir := u.abs(r.FormValue("path"))
+	if dir == u.root() {
+		http.Error(w, "缺少 path 参数", http.StatusBadRequest)
+		return
+	}
+	if err := catalog.CreateFolder(dir); err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, &Folder{Path: u.rel(dir)})
+}
+
+// handleRenameFolder POST /api/folders/rename，参数 path、name
+func handleRenameFolder(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	dir := u.abs(r.FormValue("path"))
+	name := r.FormValue("name")
+	if !validName(name) {
+		http.Error(w, "目录名不合法", http.StatusBadRequest)
+		return
+	}
+	if dir == u.root() {
+		writeCatalogError(w, errInvalidPath)
+		return
+	}
+	dst := path.Join(path.Dir(dir), strings.TrimSpace(name))
+	if err := catalog.MoveFolder(dir, dst); err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, &Folder{Path: u.rel(dst)})
+}
+
+// handleMoveFolder POST /api/folders/move，参数 path、to（目标上级目录）
+func handleMoveFolder(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	dir := u.abs(r.FormValue("path"))
+	if dir == u.root() {
+		writeCatalogError(w, errInvalidPath)
+		return
+	}
+	dst := path.Join(u.abs(r.FormValue("to")), path.Base(dir))
+	if err := catalog.MoveFolder(dir, dst); err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, &Folder{Path: u.rel(dst)})
+}
+
+// handleDeleteFolder DELETE /api/folders?path=，只能删除空目录
+func handleDeleteFolder(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permDelete)
+	if !ok {
+		return
+	}
+	dir := u.abs(r.FormValue("path"))
+	if dir == u.root() {
+		writeCatalogError(w, errInvalidPath)
+		return
+	}
+	if err := catalog.DeleteFolder(dir); err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMoveFile POST /api/files/{id}/move，参数 to（目标目录）
+func handleMoveFile(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	rec, err := getUserFile(u, r.PathValue("id"))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	rec, err = catalog.MoveFile(rec.ID, u.abs(r.FormValue("to")))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, u.viewFile(rec))
+}
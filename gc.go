@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// 孤儿分块回收：分片上传会话或 tus 会话超过宽限期仍未合并时，删除已发送到 Telegram 的分块消息。
+// 被文件目录或仍在进行的会话引用的消息永远不会被删除。
+var (
+	gcGrace    = 24 * time.Hour
+	gcInterval = time.Hour
+	gcMu       sync.Mutex
+)
+
+// GCItem 一个过期会话及其待回收的分块
+type GCItem struct {
+	Source    string      `json:"source"` // upload / tus
+	SessionID string      `json:"session_id"`
+	Filename  string      `json:"filename"`
+	Reason    string      `json:"reason"` // abandoned 未合并 / replaced 被重传替换
+	UpdatedAt time.Time   `json:"updated_at"`
+	Chunks    []ChunkInfo `json:"chunks"`
+	Errors    []string    `json:"errors,omitempty"`
+}
+
+// GCReport 一次回收的结果
+type GCReport struct {
+	DryRun     bool      `json:"dry_run"`
+	Grace      string    `json:"grace"`
+	StartedAt  time.Time `json:"started_at"`
+	Items      []GCItem  `json:"items"`
+	Messages   int       `json:"messages"`   // 待删除（或已尝试删除）的消息数
+	Deleted    int       `json:"deleted"`    // 删除成功的消息数
+	Failed     int       `json:"failed"`     // 删除失败的消息数
+	Referenced int       `json:"referenced"` // 仍被文件或活动会话引用而保留的分块数
+	Sessions   int       `json:"sessions"`   // 清理掉的会话数
+}
+
+// blobRefs 仍在使用中的分块（去重后同一条消息可能被多个文件或会话共用）
+type blobRefs struct {
+	fileIDs    map[string]bool
+	messageIDs map[int]bool
+}
+
+func (refs *blobRefs) add(fileID string, messageID int) {
+	if fileID != "" {
+		refs.fileIDs[fileID] = true
+	}
+	if messageID != 0 {
+		refs.messageIDs[messageID] = true
+	}
+}
+
+func (refs *blobRefs) has(c ChunkInfo) bool {
+	return refs.fileIDs[c.FileID] || c.MessageID != 0 && refs.messageIDs[c.MessageID]
+}
+
+// collectBlobRefs 收集文件目录中及 activeSince 之后仍有活动、尚未完成的上传会话中引用的分块，
+// excludeID 对应的文件记录或上传会话除外
+func collectBlobRefs(excludeID string, activeSince time.Time) (*blobRefs, error) {
+	list, err := catalog.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	refs := &blobRefs{fileIDs: make(map[string]bool), messageIDs: make(map[int]bool)}
+	for _, rec := range list {
+		if rec.ID == excludeID {
+			continue
+		}
+		refs.add(rec.FileID, rec.MessageID)
+		for _, c := range rec.Chunks {
+			refs.add(c.FileID, c.MessageID)
+		}
+	}
+	for _, id := range sessionStore.ids() {
+		if id == excludeID {
+			continue
+		}
+		if sess, err := sessionStore.Load(id); err == nil && sess.FileID == "" && !sess.UpdatedAt.Before(activeSince) {
+			for _, c := range sess.Chunks {
+				refs.add(c.FileID, c.MessageID)
+			}
+		}
+	}
+	for _, id := range tusStore.ids() {
+		if id == excludeID {
+			continue
+		}
+		if u, err := tusStore.Load(id); err == nil && u.FileID == "" && !u.UpdatedAt.Before(activeSince) {
+			for _, c := range u.Chunks {
+				refs.add(c.FileID, c.MessageID)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// collectGarbage 扫描所有会话，dryRun 时只返回报告，不删除任何消息和会话
+func collectGarbage(dryRun bool) (*GCReport, error) {
+	gcMu.Lock()
+	defer gcMu.Unlock()
+
+	report := &GCReport{DryRun: dryRun, Grace: gcGrace.String(), StartedAt: time.Now(), Items: []GCItem{}}
+	deadline := report.StartedAt.Add(-gcGrace)
+	refs, err := collectBlobRefs("", deadline)
+	if err != nil {
+		return nil, fmt.Errorf("读取文件目录失败: %w", err)
+	}
+
+	// sweep 删除一个会话的孤儿分块，全部成功后才移除会话状态，否则留待下次重试
+	sweep := func(item GCItem, removeSession func() error) {
+		var orphans []ChunkInfo
+		for _, c := range item.Chunks {
+			if c.FileID == "" {
+				continue
+			}
+			if refs.has(c) {
+				report.Referenced++
+				continue
+			}
+			orphans = append(orphans, c)
+		}
+		item.Chunks = orphans
+		report.Messages += len(orphans)
+		if !dryRun {
+			for _, c := range orphans {
+				if err := deleteBlob(c); err != nil {
+					report.Failed++
+					item.Errors = append(item.Errors, fmt.Sprintf("%s: %v", c.FileID, err))
+					continue
+				}
+				report.Deleted++
+			}
+			if len(item.Errors) == 0 {
+				if err := removeSession(); err != nil {
+					item.Errors = append(item.Errors, "删除会话失败: "+err.Error())
+				} else {
+					report.Sessions++
+				}
+			}
+		}
+		if len(orphans) > 0 || len(item.Errors) > 0 {
+			report.Items = append(report.Items, item)
+		}
+	}
+
+	for _, id := range sessionStore.ids() {
+		unlock := sessionStore.lock(id)
+		sess, err := sessionStore.Load(id)
+		if err == nil && sess.UpdatedAt.Before(deadline) {
+			item := GCItem{Source: "upload", SessionID: id, Filename: sess.Filename, UpdatedAt: sess.UpdatedAt}
+			if sess.FileID != "" {
+				item.Reason, item.Chunks = "replaced", sess.Replaced
+			} else {
+				item.Reason, item.Chunks = "abandoned", append(sess.Chunks, sess.Replaced...)
+			}
+			sweep(item, func() error { return sessionStore.remove(id) })
+		}
+		unlock()
+	}
+
+	for _, id := range tusStore.ids() {
+		unlock := tusStore.lock(id)
+		u, err := tusStore.Load(id)
+		if err == nil && u.UpdatedAt.Before(deadline) {
+			item := GCItem{Source: "tus", SessionID: id, Filename: u.Filename, UpdatedAt: u.UpdatedAt, Reason: "abandoned"}
+			if u.FileID == "" {
+				item.Chunks = u.Chunks
+			}
+			sweep(item, func() error { return tusStore.Remove(id) })
+		}
+		unlock()
+	}
+
+	if !dryRun && (report.Messages > 0 || report.Sessions > 0) {
+		log.Printf("孤儿分块回收完成：删除消息 %d 条，失败 %d 条，清理会话 %d 个",
+			report.Deleted, report.Failed, report.Sessions)
+	}
+	return report, nil
+}
+
+// startGC 按 gcInterval 定期回收孤儿分块
+func startGC() {
+	if gcInterval <= 0 {
+		log.Println("自动回收孤儿分块已关闭")
+		return
+	}
+	log.Printf("孤儿分块回收 - 宽限期: %s, 检查间隔: %s", gcGrace, gcInterval)
+	go func() {
+		ticker := time.NewTicker(gcInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := collectGarbage(false); err != nil {
+				log.Println("孤儿分块回收失败:", err)
+			}
+		}
+	}()
+}
+
+// handleGC GET /gc 返回预演报告（不删除），POST /gc 执行回收（dry_run=1 时同样只预演）
+func handleGC(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, permAdmin); !ok {
+		return
+	}
+	var dryRun bool
+	switch r.Method {
+	case http.MethodGet:
+		dryRun = true
+	case http.MethodPost:
+		dryRun = r.FormValue("dry_run") == "1" || r.FormValue("dry_run") == "true"
+	default:
+		http.Error(w, "只支持 GET 或 POST", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := collectGarbage(dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// gcSummary 机器人回复的回收结果摘要
+func gcSummary(report *GCReport) string {
+	var b strings.Builder
+	if report.DryRun {
+		fmt.Fprintf(&b, "🧹孤儿分块回收预演（宽限期 %s）\n\n待删除消息：%d 条\n", report.Grace, report.Messages)
+	} else {
+		fmt.Fprintf(&b, "🧹孤儿分块回收完成（宽限期 %s）\n\n删除消息：%d 条\n失败：%d 条\n清理会话：%d 个\n",
+			report.Grace, report.Deleted, report.Failed, report.Sessions)
+	}
+	if report.Referenced > 0 {
+		fmt.Fprintf(&b, "仍被引用而保留：%d 个分块\n", report.Referenced)
+	}
+	for _, item := range report.Items {
+		fmt.Fprintf(&b, "\n%s [%s/%s]：%d 个分块", item.Filename, item.Source, item.Reason, len(item.Chunks))
+		if len(item.Errors) > 0 {
+			fmt.Fprintf(&b, "，%d 个错误", len(item.Errors))
+		}
+	}
+	return b.String()
+}
+
+// handleGCCommand 机器人命令：/gc 执行回收，/gc dry 只预演
+func handleGCCommand(msg *tgbotapi.Message) {
+	dryRun := strings.TrimSpace(msg.CommandArguments()) == "dry"
+	text := ""
+	if report, err := collectGarbage(dryRun); err != nil {
+		text = "孤儿分块回收失败: " + err.Error()
+	} else {
+		text = gcSummary(report)
+	}
+	if _, err := bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text)); err != nil {
+		log.Println(err)
+	}
+}
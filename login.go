@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 登录会话：/verify 登录成功后下发 HttpOnly、SameSite 的会话 Cookie，之后的请求不必再提交密码。
+// Cookie 中是随机会话 ID 及其 HMAC 签名，服务端只保存会话 ID 的 SHA-256，/logout、修改密码、停用账号时删除
+const loginCookieName = "tgd_session"
+
+var (
+	bucketLogins = []byte("logins") // 会话 ID 的 SHA-256 -> LoginSession JSON
+
+	loginSessionTTL = 7 * 24 * time.Hour // 登录会话有效期
+
+	errLoginExpired = errors.New("登录已过期，请重新登录")
+)
+
+// LoginSession 一次网页登录
+type LoginSession struct {
+	Username string `json:"username"` // 使用 ACCESS_PWD 登录时为空
+	// PwdTag 使用 ACCESS_PWD 登录时访问密码的 HMAC，访问密码修改后会话随之失效
+	PwdTag string `json:"pwd_tag,omitempty"`
+	// TelegramID 通过 Telegram 登录时的用户 ID，移出允许列表后会话随之失效
+	TelegramID int64     `json:"telegram_id,omitempty"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// loginMAC 对 kind、value 计算 HMAC-SHA256（密钥与签名下载链接相同，通过 kind 区分用途）
+func loginMAC(kind, value string) string {
+	mac := hmac.New(sha256.New, signingSecret)
+	fmt.Fprintf(mac, "%s\n%s", kind, value)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// loginCookieID 校验 Cookie 的签名，返回会话 ID
+func loginCookieID(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(loginCookieName)
+	if err != nil {
+		return "", false
+	}
+	id, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(loginMAC("session", id))) {
+		return "", false
+	}
+	return id, true
+}
+
+func setLoginCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearLoginCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// startLoginSession 为用户 u 创建登录会话并下发 Cookie
+func startLoginSession(w http.ResponseWriter, r *http.Request, u *User) error {
+	s := newLoginSession(r, u)
+	if u.Username == "" {
+		s.PwdTag = loginMAC("access_pwd", accessPwd)
+	}
+	return saveLoginSession(w, r, s)
+}
+
+// newLoginSession 用户 u 在请求 r 中登录的会话，有效期为 loginSessionTTL
+func newLoginSession(r *http.Request, u *User) *LoginSession {
+	now := time.Now()
+	return &LoginSession{
+		Username:  u.Username,
+		IP:        clientIP(r),
+		CreatedAt: now,
+		ExpiresAt: now.Add(loginSessionTTL),
+	}
+}
+
+// saveLoginSession 保存登录会话并下发 Cookie
+func saveLoginSession(w http.ResponseWriter, r *http.Request, s *LoginSession) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	if err := catalog.PutLoginSession(hashToken(id), s); err != nil {
+		return err
+	}
+	setLoginCookie(w, r, id+"."+loginMAC("session", id), s.ExpiresAt)
+	return nil
+}
+
+// authenticateCookie 按登录 Cookie 识别用户，没有 Cookie 时 ok 为 false
+func authenticateCookie(r *http.Request) (u *User, ok bool, err error) {
+	id, ok := loginCookieID(r)
+	if !ok {
+		return nil, false, nil
+	}
+	s, err := catalog.GetLoginSession(hashToken(id))
+	if err != nil || time.Now().After(s.ExpiresAt) {
+		return nil, true, errLoginExpired
+	}
+	if s.TelegramID != 0 {
+		// 关闭 Telegram 登录、移出允许列表或对应的账号改变后会话失效
+		u, err := telegramUser(s.TelegramID)
+		switch {
+		case errors.Is(err, errUserDisabled):
+			return nil, true, err
+		case err != nil || !telegramLogin || u.Username != s.Username:
+			return nil, true, errLoginExpired
+		}
+		u.login = s
+		return u, true, nil
+	}
+	if s.Username == "" {
+		if accessPwd == "" || !hmac.Equal([]byte(s.PwdTag), []byte(loginMAC("access_pwd", accessPwd))) {
+			return nil, true, errLoginExpired
+		}
+		c := *sharedPwdUser
+		c.login = s
+		return &c, true, nil
+	}
+	owner, err := catalog.GetUser(s.Username)
+	if err != nil {
+		return nil, true, errLoginExpired
+	}
+	if owner.Disabled {
+		return nil, true, errUserDisabled
+	}
+	owner.login = s
+	return owner, true, nil
+}
+
+// PutLoginSession 保存登录会话，顺带清理已过期的会话
+func (c *Catalog) PutLoginSession(key string, s *LoginSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLogins)
+		if err := deleteLoginSessionsTx(tx, func(old *LoginSession) bool {
+			return time.Now().After(old.ExpiresAt)
+		}); err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// GetLoginSession 按会话 ID 的 SHA-256 查询登录会话
+func (c *Catalog) GetLoginSession(key string) (*LoginSession, error) {
+	var s *LoginSession
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketLogins).Get([]byte(key))
+		if data == nil {
+			return errLoginExpired
+		}
+		s = &LoginSession{}
+		return json.Unmarshal(data, s)
+	})
+	return s, err
+}
+
+// DeleteLoginSession 删除一个登录会话
+func (c *Catalog) DeleteLoginSession(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLogins).Delete([]byte(key))
+	})
+}
+
+// DeleteUserLoginSessions 删除用户的所有登录会话（username 为空时为使用 ACCESS_PWD 的会话）
+func (c *Catalog) DeleteUserLoginSessions(username string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return deleteLoginSessionsTx(tx, func(s *LoginSession) bool {
+			return s.Username == username
+		})
+	})
+}
+
+func deleteLoginSessionsTx(tx *bolt.Tx, match func(*LoginSession) bool) error {
+	b := tx.Bucket(bucketLogins)
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		s := &LoginSession{}
+		if json.Unmarshal(v, s) == nil && match(s) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleLogout POST /logout 注销当前登录会话，all=1 时注销该用户的所有登录会话
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持 POST", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := loginCookieID(r)
+	if ok {
+		var err error
+		if r.FormValue("all") == "1" || r.FormValue("all") == "true" {
+			var s *LoginSession
+			if s, err = catalog.GetLoginSession(hashToken(id)); err == nil {
+				err = catalog.DeleteUserLoginSessions(s.Username)
+			}
+		} else {
+			err = catalog.DeleteLoginSession(hashToken(id))
+		}
+		if err != nil && !errors.Is(err, errLoginExpired) {
+			http.Error(w, "注销失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	clearLoginCookie(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeLoginSessions 修改密码或停用账号后注销用户的所有登录会话
+func revokeLoginSessions(username string) {
+	if err := catalog.DeleteUserLoginSessions(username); err != nil {
+		log.Printf("注销用户 %s 的登录会话失败: %v", username, err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoginCookieID(t *testing.T) {
+	signingSecret = []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		want   string
+		ok     bool
+	}{
+		{"有效", &http.Cookie{Name: loginCookieName, Value: "abc." + loginMAC("session", "abc")}, "abc", true},
+		{"签名错误", &http.Cookie{Name: loginCookieName, Value: "abc." + loginMAC("session", "abd")}, "", false},
+		{"其他用途的签名", &http.Cookie{Name: loginCookieName, Value: "abc." + loginMAC("oidc", "abc")}, "", false},
+		{"没有签名", &http.Cookie{Name: loginCookieName, Value: "abc"}, "", false},
+		{"其他 Cookie", &http.Cookie{Name: "other", Value: "abc." + loginMAC("session", "abc")}, "", false},
+		{"没有 Cookie", nil, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.cookie != nil {
+			r.AddCookie(tt.cookie)
+		}
+		if id, ok := loginCookieID(r); id != tt.want || ok != tt.ok {
+			t.Errorf("%s: loginCookieID() = %q, %v; want %q, %v", tt.name, id, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// 登录后下发的 Cookie 属性
+func TestLoginCookieAttributes(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		proto  string
+		secure bool
+	}{
+		{"", false},
+		{"https", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/verify", nil)
+		r.Header.Set("X-Access-Pwd", "secret")
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		w := serve(http.HandlerFunc(handleVerify), r)
+		var cookie *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == loginCookieName {
+				cookie = c
+			}
+		}
+		if cookie == nil {
+			t.Fatalf("proto %q: no login cookie: %d %s", tt.proto, w.Code, w.Body)
+		}
+		if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" || cookie.Secure != tt.secure || cookie.MaxAge <= 0 {
+			t.Errorf("proto %q: cookie = %+v", tt.proto, cookie)
+		}
+	}
+}
+
+// 登录会话在注销、修改密码、停用账号、修改访问密码后失效
+func TestLoginSessionRevocation(t *testing.T) {
+	admin := func(r *http.Request) { r.Header.Set("X-Access-Pwd", "secret") }
+	alice := func(r *http.Request) { r.SetBasicAuth("alice", "alice-secret") }
+	post := func(handler http.HandlerFunc, pattern, target string, form url.Values, cookie *http.Cookie, auth func(*http.Request)) {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if auth != nil {
+			auth(r)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(pattern, handler)
+		if w := serve(mux, r); w.Code >= 300 {
+			t.Fatalf("POST %s: status %d: %s", target, w.Code, w.Body)
+		}
+	}
+	tests := []struct {
+		name   string
+		login  func(r *http.Request)
+		change func(cookie *http.Cookie)
+		want   error
+	}{
+		{"访问密码登录", admin, nil, nil},
+		{"账号登录", alice, nil, nil},
+		{"注销", alice, func(c *http.Cookie) {
+			post(handleLogout, "/logout", "/logout", nil, c, nil)
+		}, errLoginExpired},
+		{"修改密码", alice, func(*http.Cookie) {
+			post(handleUpdateUser, "POST /api/users/{name}", "/api/users/alice", url.Values{"password": {"new-secret"}}, nil, admin)
+		}, errLoginExpired},
+		{"修改角色不影响", alice, func(*http.Cookie) {
+			post(handleUpdateUser, "POST /api/users/{name}", "/api/users/alice", url.Values{"role": {"viewer"}}, nil, admin)
+		}, nil},
+		{"停用账号", alice, func(*http.Cookie) {
+			post(handleDisableUser, "POST /api/users/{name}/disable", "/api/users/alice/disable", nil, nil, admin)
+		}, errLoginExpired},
+		{"修改访问密码", admin, func(*http.Cookie) { accessPwd = "changed" }, errLoginExpired},
+		{"清空访问密码", admin, func(*http.Cookie) { accessPwd = "" }, errLoginExpired},
+		{"修改访问密码不影响账号", alice, func(*http.Cookie) { accessPwd = "changed" }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			hash, err := hashUserPassword("alice-secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := catalog.CreateUser(&User{Username: "alice", PasswordHash: hash, Role: roleUploader}); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/verify", nil)
+			tt.login(r)
+			w := serve(http.HandlerFunc(handleVerify), r)
+			cookies := w.Result().Cookies()
+			if len(cookies) == 0 {
+				t.Fatalf("login: status %d: %s", w.Code, w.Body)
+			}
+			if tt.change != nil {
+				tt.change(cookies[0])
+			}
+			r = httptest.NewRequest(http.MethodGet, "/api/files", nil)
+			r.AddCookie(cookies[0])
+			if _, ok, err := authenticateCookie(r); !ok || !errors.Is(err, tt.want) {
+				t.Errorf("authenticateCookie() = %v, %v; want %v", ok, err, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/fs"
 	"log"
@@ -12,9 +16,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
@@ -39,7 +45,9 @@ func (s staticFS) Open(name string) (http.File, error) {
 var (
 	bot                *tgbotapi.BotAPI
 	chatID             int64
+	catalog            *Catalog
 	accessPwd          string
+	baseURL            string
 	downloadThreads    = 8  // Download concurrent threads (can be higher)
 	frontendChunkSize  = 20 // Frontend chunk size in MB
 	frontendConcurrent = 8  // Frontend chunk upload concurrency
@@ -54,6 +62,7 @@ func main() {
 	proxyFlag := flag.String("proxy", "", "HTTP 代理地址")
 	chatIDFlag := flag.String("chat_id", "", "Telegram Chat ID")
 	baseURLFlag := flag.String("base_url", "", "服务的基础 URL，例如 https://yourdomain.com")
+	dataDirFlag := flag.String("data_dir", "", "本地数据目录（文件目录数据库等）")
 	flag.Parse()
 
 	envLoaded := false
@@ -93,6 +102,7 @@ func main() {
 	overrideEnv("PROXY", *proxyFlag)
 	overrideEnv("CHAT_ID", *chatIDFlag)
 	overrideEnv("BASE_URL", *baseURLFlag)
+	overrideEnv("DATA_DIR", *dataDirFlag)
 
 	// 读取最终环境变量
 	port := os.Getenv("PORT")
@@ -100,7 +110,11 @@ func main() {
 	accessPwd = os.Getenv("ACCESS_PWD")
 	proxyStr := os.Getenv("PROXY")
 	chatIDStr := os.Getenv("CHAT_ID")
-	baseURL := os.Getenv("BASE_URL")
+	baseURL = os.Getenv("BASE_URL")
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
 
 	// Read thread configuration from environment
 	if downloadThreadsStr := os.Getenv("DOWNLOAD_THREADS"); downloadThreadsStr != "" {
@@ -123,16 +137,83 @@ func main() {
 			frontendFilesLimit = val
 		}
 	}
+	if bufferStr := os.Getenv("DOWNLOAD_BUFFER_MB"); bufferStr != "" {
+		if val, err := strconv.Atoi(bufferStr); err == nil && val > 0 {
+			downloadBufferMB = val
+		}
+	}
 
-	log.Printf("配置信息 - 下载线程: %d, 分片大小: %dMB, 分片并发: %d, 文件并发: %d",
-		downloadThreads, frontendChunkSize, frontendConcurrent, frontendFilesLimit)
+	if graceStr := os.Getenv("GC_GRACE_HOURS"); graceStr != "" {
+		if val, err := strconv.Atoi(graceStr); err == nil && val > 0 {
+			gcGrace = time.Duration(val) * time.Hour
+		}
+	}
+	if intervalStr := os.Getenv("GC_INTERVAL_MINUTES"); intervalStr != "" {
+		if val, err := strconv.Atoi(intervalStr); err == nil && val >= 0 {
+			gcInterval = time.Duration(val) * time.Minute
+		}
+	}
+
+	if v := os.Getenv("DEFAULT_VISIBILITY"); v != "" {
+		vis, err := parseVisibility(v)
+		if err != nil || vis == "" {
+			log.Fatal("DEFAULT_VISIBILITY 配置错误，可选 public、link、private")
+		}
+		defaultVisibility = vis
+	}
+	if v := os.Getenv("REQUIRE_SIGNED_URLS"); v != "" {
+		requireSignedURLs, _ = strconv.ParseBool(v)
+	}
+	if ttlStr := os.Getenv("SIGNED_URL_TTL_HOURS"); ttlStr != "" {
+		if val, err := strconv.Atoi(ttlStr); err == nil && val > 0 {
+			signedURLTTL = time.Duration(val) * time.Hour
+		}
+	}
+	if ttlStr := os.Getenv("LOGIN_TTL_HOURS"); ttlStr != "" {
+		if val, err := strconv.Atoi(ttlStr); err == nil && val > 0 {
+			loginSessionTTL = time.Duration(val) * time.Hour
+		}
+	}
+	if maxStr := os.Getenv("AUTH_MAX_FAILURES"); maxStr != "" {
+		if val, err := strconv.Atoi(maxStr); err == nil && val > 0 {
+			authMaxFailures = val
+		}
+	}
+	if maxStr := os.Getenv("AUTH_GLOBAL_MAX_FAILURES"); maxStr != "" {
+		if val, err := strconv.Atoi(maxStr); err == nil && val > 0 {
+			authGlobalMaxFailures = val
+		}
+	}
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		list, err := parseTrustedProxies(proxies)
+		if err != nil {
+			log.Fatal("TRUSTED_PROXIES 配置错误: ", err)
+		}
+		trustedProxies = list
+	}
+
+	if err := loadEncryptionKeys(os.Getenv("ENCRYPTION_KEYS")); err != nil {
+		log.Fatal("ENCRYPTION_KEYS 配置错误: ", err)
+	}
+	if err := setCompression(os.Getenv("COMPRESSION")); err != nil {
+		log.Fatal("COMPRESSION 配置错误: ", err)
+	}
+	if compressionAlg != "" {
+		log.Printf("已开启透明压缩: %s", compressionAlg)
+	}
+	if encryptionEnabled() {
+		log.Printf("已开启分块加密，当前密钥: %s，共 %d 个密钥", encryptionKeyID, len(encryptionKeys))
+	}
+
+	log.Printf("配置信息 - 下载线程: %d, 下载缓冲: %dMB, 分片大小: %dMB, 分片并发: %d, 文件并发: %d",
+		downloadThreads, downloadBufferMB, frontendChunkSize, frontendConcurrent, frontendFilesLimit)
 
 	// 检查必填
 	if port == "" && !envLoaded {
 		log.Fatal("未找到 .env 文件，必须通过 -port 指定服务端口")
 	}
-	if botToken == "" || accessPwd == "" || chatIDStr == "" {
-		log.Fatal("缺少必要配置，请通过 .env 或命令行设置 bot_token、access_pwd、chat_id")
+	if botToken == "" || chatIDStr == "" {
+		log.Fatal("缺少必要配置，请通过 .env 或命令行设置 bot_token、chat_id")
 	}
 
 	var err error
@@ -140,6 +221,41 @@ func main() {
 	if err != nil {
 		log.Fatal("CHAT_ID 格式错误，应为数字:", err)
 	}
+	if oidcConf, err = loadOIDCConfig(); err != nil {
+		log.Fatal("OIDC 配置错误: ", err)
+	}
+	if telegramUsers, err = parseTelegramUsers(os.Getenv("TELEGRAM_USERS")); err != nil {
+		log.Fatal("TELEGRAM_USERS 配置错误: ", err)
+	}
+	if v := os.Getenv("TELEGRAM_LOGIN"); v != "" {
+		telegramLogin, _ = strconv.ParseBool(v)
+	}
+	loginKey := sha256.Sum256([]byte(botToken))
+	telegramLoginKey = loginKey[:]
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Fatal("创建数据目录失败:", err)
+	}
+	catalog, err = openCatalog(filepath.Join(dataDir, "tg-disk.db"))
+	if err != nil {
+		log.Fatal("打开文件目录数据库失败:", err)
+	}
+	defer catalog.Close()
+	if accessPwd == "" && oidcConf == nil && !telegramLogin && !catalog.HasUsers() {
+		log.Fatal("缺少必要配置 access_pwd：尚未创建任何用户且未启用 OIDC、Telegram 登录时必须设置访问密码")
+	}
+	if err := loadSigningSecret(os.Getenv("SIGNING_SECRET"), filepath.Join(dataDir, "signing.key")); err != nil {
+		log.Fatal("读取签名密钥失败:", err)
+	}
+	tusStore, err = openTusStore(filepath.Join(dataDir, "tus"))
+	if err != nil {
+		log.Fatal("创建 tus 会话目录失败:", err)
+	}
+	sessionStore, err = openSessionStore(filepath.Join(dataDir, "sessions"))
+	if err != nil {
+		log.Fatal("创建上传会话目录失败:", err)
+	}
+	startGC()
 
 	if proxyStr != "" {
 		proxyURL, err := url.Parse(proxyStr)
@@ -175,13 +291,38 @@ func main() {
 		updates := bot.GetUpdatesChan(u)
 
 		for update := range updates {
-			if update.Message == nil || update.Message.ReplyToMessage == nil {
+			if update.Message == nil || (update.Message.ReplyToMessage == nil && !update.Message.IsCommand()) {
 				continue
 			}
-			if update.Message.From.ID != chatID {
+			if !canUseBot(update.Message.From.ID) {
 				_, _ = bot.Send(tgbotapi.NewMessage(update.Message.From.ID, "您无权限使用此机器人"))
 				continue
 			}
+			switch update.Message.Command() {
+			case "gc":
+				handleGCCommand(update.Message)
+				continue
+			case "share":
+				handleShareCommand(update.Message)
+				continue
+			}
+			if update.Message.ReplyToMessage == nil {
+				continue
+			}
+			switch update.Message.Command() {
+			case "delete":
+				handleDeleteCommand(update.Message)
+				continue
+			case "rename":
+				handleRenameCommand(update.Message)
+				continue
+			case "sign":
+				handleSignCommand(update.Message)
+				continue
+			case "visibility":
+				handleVisibilityCommand(update.Message)
+				continue
+			}
 
 			// 只处理私聊
 			msgText := strings.TrimSpace(update.Message.Text)
@@ -197,34 +338,25 @@ func main() {
 					msg = update.Message
 				}
 
-				var fileID, fileName string
-				replyToMessage := msg.ReplyToMessage
-
-				switch {
-				case replyToMessage.Document != nil && replyToMessage.Document.FileID != "":
-					fileID = replyToMessage.Document.FileID
-					fileName = replyToMessage.Document.FileName
-				case replyToMessage.Video != nil && replyToMessage.Video.FileID != "":
-					fileID = replyToMessage.Video.FileID
-					fileName = replyToMessage.Video.FileName
-				case replyToMessage.Audio != nil && replyToMessage.Audio.FileID != "":
-					fileID = replyToMessage.Audio.FileID
-					fileName = replyToMessage.Audio.FileName
-				case replyToMessage.Animation != nil && replyToMessage.Animation.FileID != "":
-					fileID = replyToMessage.Animation.FileID
-					fileName = replyToMessage.Animation.FileName
-				case replyToMessage.Sticker != nil && replyToMessage.Sticker.FileID != "":
-					fileID = replyToMessage.Sticker.FileID
-					fileName = replyToMessage.Sticker.Emoji
-				}
+				fileID, fileName := replyFile(msg.ReplyToMessage)
 
 				var downloadURL string
-				if fileName == "fileAll.txt" {
+				if rec, err := catalog.GetFile(fileID); err == nil && rec.visibility() == visibilityPrivate {
+					// 私有文件需要签名才能下载
+					downloadURL, _ = signedFileLink(baseURL, rec, signedURLTTL)
+				} else if err == nil {
+					downloadURL = fileLink(baseURL, rec)
+				} else if defaultVisibility == visibilityPrivate {
+					name := fileName
+					if isManifestName(name) {
+						name = ""
+					}
+					downloadURL, _ = signedDownloadLink(baseURL, fileID, name, signedURLTTL)
+				} else if isManifestName(fileName) {
 					// 大文件，使用流式下载
-					downloadURL = fmt.Sprintf("%s/d?file_id=%s", strings.TrimRight(baseURL, "/"), fileID)
+					downloadURL = downloadLink(baseURL, fileID, "")
 				} else {
-					downloadURL = fmt.Sprintf("%s/d?file_id=%s&filename=%s",
-						strings.TrimRight(baseURL, "/"), fileID, url.QueryEscape(fileName))
+					downloadURL = downloadLink(baseURL, fileID, fileName)
 				}
 
 				var msgRsp tgbotapi.MessageConfig
@@ -247,11 +379,47 @@ func main() {
 	}
 	http.Handle("/", http.FileServer(staticFS{http.FS(httpFS)}))
 	http.HandleFunc("/verify", handleVerify)
+	http.HandleFunc("/logout", handleLogout)
+	http.HandleFunc("GET /oidc/login", handleOIDCLogin)
+	http.HandleFunc("GET /oidc/callback", handleOIDCCallback)
+	http.HandleFunc("GET /telegram/login", handleTelegramLogin)
 	http.HandleFunc("/config", handleConfig)
 	http.HandleFunc("/upload", handleUpload)
+	http.HandleFunc("/upload_session", handleUploadSession)
 	http.HandleFunc("/upload_chunk", handleUploadChunk)
 	http.HandleFunc("/merge_chunks", handleMergeChunks)
 	http.HandleFunc("/d", handleDownload)
+	http.HandleFunc("/verify_file", handleVerifyFile)
+	http.HandleFunc("/gc", handleGC)
+	http.HandleFunc("/tus", handleTus)
+	http.HandleFunc("/tus/", handleTus)
+	http.HandleFunc("GET /api/files", handleListFiles)
+	http.HandleFunc("GET /api/files/{id}", handleGetFile)
+	http.HandleFunc("DELETE /api/files/{id}", handleDeleteFile)
+	http.HandleFunc("POST /api/files/{id}/move", handleMoveFile)
+	http.HandleFunc("POST /api/files/{id}/rename", handleRenameFile)
+	http.HandleFunc("POST /api/files/{id}/visibility", handleSetVisibility)
+	http.HandleFunc("GET /api/files/{id}/shares", handleListShares)
+	http.HandleFunc("POST /api/files/{id}/shares", handleCreateShare)
+	http.HandleFunc("GET /api/shares", handleListShares)
+	http.HandleFunc("DELETE /api/shares/{token}", handleRevokeShare)
+	http.HandleFunc("GET /s/{token}", handleShareDownload)
+	http.HandleFunc("POST /s/{token}", handleShareDownload)
+	http.HandleFunc("GET /f/{id}", handlePublicDownload)
+	http.HandleFunc("POST /api/sign", handleSign)
+	http.HandleFunc("GET /api/users", handleListUsers)
+	http.HandleFunc("POST /api/users", handleCreateUser)
+	http.HandleFunc("POST /api/users/{name}", handleUpdateUser)
+	http.HandleFunc("POST /api/users/{name}/disable", handleDisableUser)
+	http.HandleFunc("POST /api/users/{name}/enable", handleDisableUser)
+	http.HandleFunc("GET /api/tokens", handleListTokens)
+	http.HandleFunc("POST /api/tokens", handleCreateToken)
+	http.HandleFunc("DELETE /api/tokens/{id}", handleRevokeToken)
+	http.HandleFunc("GET /api/folders", handleListFolder)
+	http.HandleFunc("POST /api/folders", handleCreateFolder)
+	http.HandleFunc("POST /api/folders/rename", handleRenameFolder)
+	http.HandleFunc("POST /api/folders/move", handleMoveFolder)
+	http.HandleFunc("DELETE /api/folders", handleDeleteFolder)
 
 	if port == "" {
 		port = "8080" // fallback
@@ -261,9 +429,11 @@ func main() {
 }
 
 type UploadResult struct {
-	Filename    string `json:"filename"`
-	FileID      string `json:"file_id"`
-	DownloadURL string `json:"download_url"`
+	Filename     string `json:"filename"`
+	FileID       string `json:"file_id"`
+	PublicID     string `json:"public_id,omitempty"`
+	DownloadURL  string `json:"download_url"`
+	Deduplicated bool   `json:"deduplicated,omitempty"` // 内容已存在，未重新发送到 Telegram
 }
 
 // handleUpload handles small file upload (<=20MB)
@@ -272,8 +442,12 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "只支持 POST", http.StatusMethodNotAllowed)
 		return
 	}
-	if r.FormValue("pwd") != accessPwd {
-		http.Error(w, "密码错误", http.StatusUnauthorized)
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	vis, ok := uploadVisibility(w, r)
+	if !ok {
 		return
 	}
 
@@ -292,200 +466,162 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	defer os.RemoveAll(tmpDir)
 
 	origFilename := header.Filename
-	tmpPath := filepath.Join(tmpDir, origFilename)
-	tmp, err := os.Create(tmpPath)
-	if err != nil {
-		http.Error(w, "创建临时文件失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer tmp.Close()
-
-	_, err = io.Copy(tmp, file)
-	if err != nil {
-		http.Error(w, "写入临时文件失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	var fileId string
-	doc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(tmpPath))
-	doc.Caption = origFilename
-	msg, err := bot.Send(doc)
-	if err != nil {
-		log.Println("上传到 Telegram 失败: "+err.Error(), err)
-		http.Error(w, "上传到 Telegram 失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if msg.Document != nil {
-		fileId = msg.Document.FileID
-	} else if msg.Video != nil {
-		fileId = msg.Video.FileID
-	} else if msg.Audio != nil {
-		fileId = msg.Audio.FileID
-	}
-
-	downloadURL := fmt.Sprintf("%s://%s/d?file_id=%s&filename=%s",
-		getScheme(r), r.Host, fileId, origFilename)
-
-	result := UploadResult{
-		Filename:    origFilename,
-		FileID:      fileId,
-		DownloadURL: downloadURL,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
-}
-
-// handleUploadChunk handles single chunk upload from frontend
-func handleUploadChunk(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "只支持 POST", http.StatusMethodNotAllowed)
-		return
-	}
-	if r.FormValue("pwd") != accessPwd {
-		http.Error(w, "密码错误", http.StatusUnauthorized)
+	dir := u.abs(r.FormValue("path"))
+	existing, err := catalog.GetFileByPath(path.Join(dir, origFilename))
+	if err == nil && existing.Size != header.Size {
+		http.Error(w, "目标路径已存在同名文件", http.StatusConflict)
 		return
 	}
 
-	chunk, _, err := r.FormFile("chunk")
-	if err != nil {
-		http.Error(w, "读取分片失败: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-	defer chunk.Close()
-
-	chunkIndex := r.FormValue("chunk_index")
-	totalChunks := r.FormValue("total_chunks")
-	filename := r.FormValue("filename")
-
-	tmpDir, err := os.MkdirTemp("", "chunk_")
-	if err != nil {
-		http.Error(w, "创建临时目录失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer os.RemoveAll(tmpDir)
-
-	chunkPath := filepath.Join(tmpDir, "blob")
-	tmp, err := os.Create(chunkPath)
+	tmpPath := filepath.Join(tmpDir, origFilename)
+	tmp, err := os.Create(tmpPath)
 	if err != nil {
 		http.Error(w, "创建临时文件失败: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer tmp.Close()
 
-	_, err = io.Copy(tmp, chunk)
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), file)
 	if err != nil {
 		http.Error(w, "写入临时文件失败: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	tmp.Close()
-
-	// Build caption with chunk info
-	caption := fmt.Sprintf("blob [%s/%s] - %s", chunkIndex, totalChunks, filename)
+	sha := hex.EncodeToString(hasher.Sum(nil))
 
-	// Upload chunk to Telegram
-	doc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(chunkPath))
-	doc.Caption = caption
-	msg, err := bot.Send(doc)
-	if err != nil || msg.Document == nil {
-		http.Error(w, "上传分片到 Telegram 失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	var rec *FileRecord
+	var deduplicated bool
+	switch {
+	case existing != nil:
+		// 同一路径已有内容相同的文件（如 CI 重复上传），直接返回
+		if !existing.sameContent(sha) {
+			http.Error(w, "目标路径已存在同名文件", http.StatusConflict)
+			return
+		}
+		rec, deduplicated = applyUploadVisibility(existing, vis), true
+	case encryptionEnabled() || compressionFor(origFilename, tmpPath) != "":
+		// 需要加密或压缩时按只有一个分块的清单保存，密钥 ID、nonce 及压缩算法记录在清单中
+		info, err := sendChunkFile(tmpPath, chunkCaption(0, 1, origFilename), origFilename, dedupRequested(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rec, err = commitManifest(newManifest(origFilename, []ChunkInfo{info}), dir, u.actor(), vis)
+		if errors.Is(err, errPathExists) {
+			writeCatalogError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		var fileId string
+		var messageID int
+		var blob ChunkInfo
+		if dedupRequested(r) {
+			blob, deduplicated = dedupBlob(sha, header.Size, true)
+		}
+		if deduplicated {
+			fileId, messageID = blob.FileID, blob.MessageID
+		} else {
+			doc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(tmpPath))
+			doc.Caption = origFilename
+			msg, err := bot.Send(doc)
+			if err != nil {
+				log.Println("上传到 Telegram 失败: "+err.Error(), err)
+				http.Error(w, "上传到 Telegram 失败: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if msg.Document != nil {
+				fileId = msg.Document.FileID
+			} else if msg.Video != nil {
+				fileId = msg.Video.FileID
+			} else if msg.Audio != nil {
+				fileId = msg.Audio.FileID
+			}
+			messageID = msg.MessageID
+			rememberBlob(ChunkInfo{FileID: fileId, Size: header.Size, SHA256: sha, MessageID: messageID})
+		}
 
-	type ChunkResult struct {
-		FileID string `json:"file_id"`
+		rec = &FileRecord{
+			Filename:   origFilename,
+			Path:       dir,
+			Size:       header.Size,
+			MimeType:   mimeTypeOf(origFilename),
+			SHA256:     sha,
+			FileID:     fileId,
+			MessageID:  messageID,
+			Uploader:   u.actor(),
+			Visibility: vis,
+		}
+		if err := recordUpload(rec); err != nil {
+			writeCatalogError(w, err)
+			return
+		}
 	}
 
-	result := ChunkResult{
-		FileID: msg.Document.FileID,
+	result := UploadResult{
+		Filename:     origFilename,
+		FileID:       rec.FileID,
+		PublicID:     rec.PublicID,
+		DownloadURL:  fileLink(getScheme(r)+"://"+r.Host, rec),
+		Deduplicated: deduplicated,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
-// handleMergeChunks creates fileAll.txt and uploads it to Telegram
-func handleMergeChunks(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "只支持 POST", http.StatusMethodNotAllowed)
-		return
-	}
-	if r.FormValue("pwd") != accessPwd {
-		http.Error(w, "密码错误", http.StatusUnauthorized)
-		return
-	}
-
-	filename := r.FormValue("filename")
-	chunkIDsJSON := r.FormValue("chunk_ids")
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Query().Get("file_id")
+	filename := r.URL.Query().Get("filename")
 
-	if filename == "" || chunkIDsJSON == "" {
-		http.Error(w, "缺少 filename 或 chunk_ids 参数", http.StatusBadRequest)
+	// 按虚拟路径下载，如 /d?path=/projects/foo/build.tar；路径可以猜测，不算作持有链接。
+	// 秒传的多条记录共用同一个 file_id，只按路径对应的这条记录检查权限
+	if p := r.URL.Query().Get("path"); fileID == "" && p != "" {
+		rec, err := catalog.GetFileByPath(p)
+		if err != nil {
+			writeCatalogError(w, err)
+			return
+		}
+		if err := verifySignature(r.URL.Query(), rec.FileID, recordFilename(rec)); err != nil {
+			writeSignatureError(w, err)
+			return
+		}
+		if !authorizeDownload(w, r, []*FileRecord{rec}, false) {
+			return
+		}
+		serveFile(w, r, rec.FileID, recordFilename(rec))
 		return
 	}
 
-	var chunkIDs []string
-	if err := json.Unmarshal([]byte(chunkIDsJSON), &chunkIDs); err != nil {
-		http.Error(w, "chunk_ids 格式错误: "+err.Error(), http.StatusBadRequest)
+	if fileID == "" {
+		http.Error(w, "缺少 file_id 或 path 参数", http.StatusBadRequest)
 		return
 	}
-
-	if len(chunkIDs) == 0 {
-		http.Error(w, "chunk_ids 不能为空", http.StatusBadRequest)
+	if err := verifySignature(r.URL.Query(), fileID, filename); err != nil {
+		writeSignatureError(w, err)
 		return
 	}
-
-	// Build fileAll.txt content
-	builder := strings.Builder{}
-	builder.WriteString(filename + "\n")
-	for _, fid := range chunkIDs {
-		builder.WriteString(fid + "\n")
-	}
-
-	tmpDir, err := os.MkdirTemp("", "merge_")
+	recs, err := catalog.FilesByFileID(fileID)
 	if err != nil {
-		http.Error(w, "创建临时目录失败: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "读取文件目录失败: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer os.RemoveAll(tmpDir)
-
-	metaPath := filepath.Join(tmpDir, "fileAll.txt")
-	if err := os.WriteFile(metaPath, []byte(builder.String()), 0644); err != nil {
-		http.Error(w, "写入 fileAll.txt 失败: "+err.Error(), http.StatusInternalServerError)
+	if !authorizeDownload(w, r, recs, true) {
 		return
 	}
-
-	// Upload fileAll.txt to Telegram
-	metaDoc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(metaPath))
-	metaDoc.Caption = filename
-	msg, err := bot.Send(metaDoc)
-	if err != nil || msg.Document == nil {
-		http.Error(w, "上传 fileAll.txt 失败: "+err.Error(), http.StatusInternalServerError)
+	if redirectRenamed(w, r, recs, fileID, filename) {
 		return
 	}
-
-	fileID := msg.Document.FileID
-	// 大文件直接使用流式下载
-	downloadURL := fmt.Sprintf("%s://%s/d?file_id=%s", getScheme(r), r.Host, fileID)
-
-	result := UploadResult{
-		Filename:    filename,
-		FileID:      fileID,
-		DownloadURL: downloadURL,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	serveFile(w, r, fileID, filename)
 }
 
-func handleDownload(w http.ResponseWriter, r *http.Request) {
-	fileID := r.URL.Query().Get("file_id")
-	filename := r.URL.Query().Get("filename")
-
-	if fileID == "" {
-		http.Error(w, "缺少 file_id 参数", http.StatusBadRequest)
-		return
-	}
-
+// serveFile 输出文件内容：filename 非空为单文件，否则 fileID 为清单
+func serveFile(w http.ResponseWriter, r *http.Request, fileID, filename string) {
 	// filename 参数存在，表示是小文件，直接下载
 	if filename != "" {
-		tgFile, err := bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+		tgFile, err := getTelegramFile(fileID)
 		if err != nil {
 			// Check if error is due to file being too large
 			errMsg := err.Error()
@@ -507,8 +643,6 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
         .solution h3 { color: #0c5460; margin-top: 0; }
         code { background: #f4f4f4; padding: 2px 6px; border-radius: 3px; }
         ol { line-height: 1.8; }
-        .telegram-link { display: inline-block; background: #0088cc; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; margin-top: 10px; }
-        .telegram-link:hover { background: #006699; }
     </style>
 </head>
 <body>
@@ -529,12 +663,11 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
         </ol>
         
         <p><strong>方法二：直接在 Telegram 中下载</strong></p>
-        <p>在 Telegram 客户端中打开此文件即可直接下载（不受 20MB 限制）</p>
-        <a href="https://t.me/c/%d/%s" class="telegram-link" target="_blank">📱 在 Telegram 中打开</a>
+        <p>在 Telegram 客户端中找到此文件即可直接下载（不受 20MB 限制）</p>
     </div>
 </body>
 </html>
-`, filename, getScheme(r)+"://"+r.Host, chatID, fileID)
+`, html.EscapeString(filename), html.EscapeString(getScheme(r)+"://"+r.Host))
 				return
 			}
 			http.Error(w, "获取文件失败: "+err.Error(), http.StatusInternalServerError)
@@ -582,17 +715,9 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
     </div>
 </body>
 </html>
-`, fileSize, filename, getScheme(r)+"://"+r.Host)
-			return
-		}
-
-		url := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", bot.Token, tgFile.FilePath)
-		resp, err := http.Get(url)
-		if err != nil {
-			http.Error(w, "下载失败: "+err.Error(), http.StatusInternalServerError)
+`, fileSize, html.EscapeString(filename), html.EscapeString(getScheme(r)+"://"+r.Host))
 			return
 		}
-		defer resp.Body.Close()
 
 		ext := filepath.Ext(filename)
 		contentType := mime.TypeByExtension(ext)
@@ -614,74 +739,54 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 
 		}
 
-		w.Header().Set("Content-Type", contentType)
 		// 仅在不能预览时强制下载
 		if !isPreviewable(contentType) {
 			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
 		}
-		w.Header().Set("Accept-Ranges", "bytes")
-		io.Copy(w, resp.Body)
-		return
-	}
-
-	// 否则为 fileAll.txt 模式（大文件组合下载）
-	tgFile, err := bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
-	if err != nil {
-		http.Error(w, "获取 fileAll.txt 失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	url := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", bot.Token, tgFile.FilePath)
-	resp, err := http.Get(url)
-	if err != nil {
-		http.Error(w, "下载 fileAll.txt 失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
+		if tgFile.FileUniqueID != "" {
+			w.Header().Set("ETag", `"`+tgFile.FileUniqueID+`"`)
+		}
+		blob := ChunkInfo{FileID: fileID, Size: int64(tgFile.FileSize)}
+		var modTime time.Time
+		if rec, err := catalog.GetFile(fileID); err == nil {
+			modTime = rec.UploadedAt
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			blob.SHA256 = rec.SHA256
+		}
+		if checkNotModified(w, r, modTime) {
+			return
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, fmt.Sprintf("下载 fileAll.txt 返回状态异常: %d", resp.StatusCode), http.StatusInternalServerError)
+		if err := serveRanges(w, r, contentType, []ChunkInfo{blob}); err != nil {
+			reportDownloadError(filename, err)
+		}
 		return
 	}
 
-	linesBytes, err := io.ReadAll(resp.Body)
+	// 否则为清单模式（fileAll.json / fileAll.txt 大文件组合下载）
+	manifest, err := fetchManifest(r.Context(), fileID)
 	if err != nil {
-		http.Error(w, "读取 fileAll.txt 失败: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	linesStr := strings.Split(strings.TrimSpace(string(linesBytes)), "\n")
-
-	// 去掉空行
-	var cleanLines []string
-	for _, line := range linesStr {
-		line = strings.TrimSpace(line)
-		if line != "" {
-			cleanLines = append(cleanLines, line)
-		}
-	}
-
-	if len(cleanLines) < 2 {
-		http.Error(w, "fileAll.txt 格式错误，至少应有文件名和一个分块ID", http.StatusBadRequest)
+		http.Error(w, "读取清单失败: "+err.Error(), http.StatusBadGateway)
 		return
 	}
 
-	origFilename := cleanLines[0]
-	blobFileIDs := cleanLines[1:]
-
 	// 直接使用流式模式下载
-	handleStreamDownloadSerial(w, r, origFilename, blobFileIDs)
+	handleStreamDownloadSerial(w, r, manifest)
 }
 
-// handleStreamDownloadSerial 串行下载并立即传输（解决并发等待问题）
-func handleStreamDownloadSerial(w http.ResponseWriter, r *http.Request, origFilename string, blobFileIDs []string) {
-	// 根据文件扩展名设置正确的 Content-Type
-	ext := filepath.Ext(origFilename)
-	contentType := mime.TypeByExtension(ext)
+// handleStreamDownloadSerial 按 DOWNLOAD_THREADS 并发预取分块、按顺序流式传输，支持单个及多个 Range 请求
+func handleStreamDownloadSerial(w http.ResponseWriter, r *http.Request, manifest *Manifest) {
+	origFilename, chunks := manifest.Filename, manifest.Chunks
+	if err := checkChunkKeys(chunks); err != nil {
+		http.Error(w, "无法解密文件: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 优先使用清单中记录的 MIME 类型，否则根据文件扩展名推断
+	contentType := manifest.MimeType
 	if contentType == "" {
-		contentType = "application/octet-stream"
+		contentType = mimeTypeOf(origFilename)
 	}
 
-	w.Header().Set("Content-Type", contentType)
 	// 根据文件类型决定是预览还是下载
 	if isPreviewable(contentType) {
 		// 可预览的文件使用 inline
@@ -690,108 +795,86 @@ func handleStreamDownloadSerial(w http.ResponseWriter, r *http.Request, origFile
 		// 不可预览的文件强制下载
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", origFilename))
 	}
-	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("X-Accel-Buffering", "no")
 	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "服务器不支持 Flush", http.StatusInternalServerError)
+	log.Printf("开始流式下载：%s，共 %d 个分块，预取线程: %d", origFilename, len(chunks), downloadThreads)
+	if err := serveRanges(w, r, contentType, chunks); err != nil {
+		reportDownloadError(origFilename, err)
 		return
 	}
-
-	log.Printf("开始串行流式下载：%s，共 %d 个分块", origFilename, len(blobFileIDs))
-
-	// 立即发送响应头
-	w.Write([]byte{})
-	flusher.Flush()
-
-	// 串行下载并立即传输
-	for i, fid := range blobFileIDs {
-		// 检查连接是否断开
-		select {
-		case <-r.Context().Done():
-			log.Printf("客户端已断开，中止下载")
-			return
-		default:
-		}
-
-		log.Printf("正在下载分块 %d/%d", i+1, len(blobFileIDs))
-
-		tgBlob, err := bot.GetFile(tgbotapi.FileConfig{FileID: fid})
-		if err != nil {
-			log.Printf("获取分块 %d 失败: %v", i+1, err)
-			http.Error(w, fmt.Sprintf("获取分块 %d 失败", i+1), http.StatusInternalServerError)
-			return
-		}
-
-		blobURL := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", bot.Token, tgBlob.FilePath)
-		resp, err := http.Get(blobURL)
-		if err != nil {
-			log.Printf("下载分块 %d 失败: %v", i+1, err)
-			http.Error(w, fmt.Sprintf("下载分块 %d 失败", i+1), http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("下载分块 %d 状态码异常: %d", i+1, resp.StatusCode)
-			http.Error(w, fmt.Sprintf("下载分块 %d 失败", i+1), http.StatusInternalServerError)
-			return
-		}
-
-		// 直接流式复制，边下载边传输
-		written, err := io.Copy(w, resp.Body)
-		if err != nil {
-			log.Printf("传输分块 %d 失败: %v", i+1, err)
-			return
-		}
-
-		flusher.Flush()
-		log.Printf("已传输分块 %d/%d，大小: %d 字节", i+1, len(blobFileIDs), written)
-	}
-
-	log.Printf("串行下载完成: %s", origFilename)
+	log.Printf("流式下载完成: %s", origFilename)
 }
 
+// handleVerify POST /verify 校验密码并下发登录 Cookie，GET /verify 返回当前登录的用户
 func handleVerify(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "只支持 POST", http.StatusMethodNotAllowed)
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		http.Error(w, "只支持 GET 或 POST", http.StatusMethodNotAllowed)
 		return
 	}
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "解析表单失败", http.StatusBadRequest)
+	u, ok := authorize(w, r, permRead)
+	if !ok {
 		return
 	}
-	if r.FormValue("pwd") == accessPwd {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	} else {
-		http.Error(w, "密码错误", http.StatusUnauthorized)
+	if r.Method == http.MethodPost && u.token == nil && u.login == nil {
+		if err := startLoginSession(w, r, u); err != nil {
+			http.Error(w, "创建登录会话失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("用户 %s 登录，IP: %s", u.Username, clientIP(r))
 	}
+	writeJSON(w, u.public())
 }
 
 func handleConfig(w http.ResponseWriter, r *http.Request) {
 	type ConfigResponse struct {
-		ChunkSizeMB     int `json:"chunk_size_mb"`
-		ChunkConcurrent int `json:"chunk_concurrent"`
-		FilesConcurrent int `json:"files_concurrent"`
-		DownloadThreads int `json:"download_threads"`
+		ChunkSizeMB     int    `json:"chunk_size_mb"`
+		ChunkSize       int64  `json:"chunk_size"` // 分片字节数，开启加密时会扣除密文多出的字节
+		ChunkConcurrent int    `json:"chunk_concurrent"`
+		FilesConcurrent int    `json:"files_concurrent"`
+		DownloadThreads int    `json:"download_threads"`
+		OIDC            bool   `json:"oidc"`                   // 是否可以使用单点登录
+		TelegramBot     string `json:"telegram_bot,omitempty"` // 启用 Telegram 登录时为机器人用户名
 	}
 
 	config := ConfigResponse{
 		ChunkSizeMB:     frontendChunkSize,
+		ChunkSize:       uploadChunkSize(),
 		ChunkConcurrent: frontendConcurrent,
 		FilesConcurrent: frontendFilesLimit,
 		DownloadThreads: downloadThreads,
+		OIDC:            oidcConf != nil,
+	}
+	if telegramLogin {
+		config.TelegramBot = bot.Self.UserName
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(config)
 }
 
+// replyFile 获取被回复消息中的文件 file_id 及文件名
+func replyFile(replyToMessage *tgbotapi.Message) (fileID, fileName string) {
+	switch {
+	case replyToMessage.Document != nil && replyToMessage.Document.FileID != "":
+		fileID = replyToMessage.Document.FileID
+		fileName = replyToMessage.Document.FileName
+	case replyToMessage.Video != nil && replyToMessage.Video.FileID != "":
+		fileID = replyToMessage.Video.FileID
+		fileName = replyToMessage.Video.FileName
+	case replyToMessage.Audio != nil && replyToMessage.Audio.FileID != "":
+		fileID = replyToMessage.Audio.FileID
+		fileName = replyToMessage.Audio.FileName
+	case replyToMessage.Animation != nil && replyToMessage.Animation.FileID != "":
+		fileID = replyToMessage.Animation.FileID
+		fileName = replyToMessage.Animation.FileName
+	case replyToMessage.Sticker != nil && replyToMessage.Sticker.FileID != "":
+		fileID = replyToMessage.Sticker.FileID
+		fileName = replyToMessage.Sticker.Emoji
+	}
+	return
+}
+
 func getScheme(r *http.Request) string {
 	// 优先使用反向代理头部判断协议
 	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
@@ -803,6 +886,14 @@ func getScheme(r *http.Request) string {
 	return "http"
 }
 
+// mimeTypeOf 根据文件扩展名推断 MIME 类型
+func mimeTypeOf(filename string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
 func isPreviewable(contentType string) bool {
 	return strings.HasPrefix(contentType, "image/") ||
 		strings.HasPrefix(contentType, "video/") ||
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeTelegram 模拟 Bot API：发送文档、获取文件、下载文件、删除消息、修改说明
+type fakeTelegram struct {
+	mu       sync.Mutex
+	files    map[string][]byte // file_id -> 文件内容
+	messages map[int]string    // message_id -> file_id
+	captions map[int]string
+	names    map[int]string // message_id -> 文档的文件名
+	deleted  []int
+	nextID   int
+	failSend bool            // sendDocument 返回错误
+	failNext int             // 接下来的 failNext 次 sendDocument 返回错误
+	tooBig   map[string]bool // getFile 返回文件过大
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		data, ok := f.files[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+	reply := func(v any) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, `{"ok":true,"result":%s}`, data)
+	}
+	fail := func(desc string) {
+		fmt.Fprintf(w, `{"ok":false,"error_code":400,"description":%q}`, desc)
+	}
+	r.ParseMultipartForm(32 << 20)
+	messageID := func() int {
+		var id int
+		fmt.Sscan(r.FormValue("message_id"), &id)
+		return id
+	}
+	switch method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]; method {
+	case "getMe":
+		reply(map[string]any{"id": 1, "is_bot": true, "username": "testbot"})
+	case "sendDocument":
+		if f.failSend || f.failNext > 0 {
+			f.failNext = max(f.failNext-1, 0)
+			fail("Bad Request: failed to send document")
+			return
+		}
+		file, header, err := r.FormFile("document")
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		data, _ := io.ReadAll(file)
+		fileID := f.put(data)
+		f.captions[f.nextID] = r.FormValue("caption")
+		f.names[f.nextID] = header.Filename
+		reply(map[string]any{"message_id": f.nextID, "date": 0, "chat": map[string]any{"id": chatID},
+			"document": map[string]any{"file_id": fileID, "file_unique_id": "u" + fileID, "file_size": len(data), "file_name": header.Filename}})
+	case "getFile":
+		fileID := r.FormValue("file_id")
+		if f.tooBig[fileID] {
+			fail("Bad Request: file is too big")
+			return
+		}
+		data, ok := f.files[fileID]
+		if !ok {
+			fail("Bad Request: invalid file_id")
+			return
+		}
+		reply(map[string]any{"file_id": fileID, "file_unique_id": "u" + fileID, "file_size": len(data), "file_path": "documents/" + fileID})
+	case "deleteMessage":
+		id := messageID()
+		if _, ok := f.messages[id]; !ok {
+			fail("Bad Request: message to delete not found")
+			return
+		}
+		delete(f.messages, id)
+		f.deleted = append(f.deleted, id)
+		reply(true)
+	case "editMessageCaption":
+		id := messageID()
+		f.captions[id] = r.FormValue("caption")
+		reply(map[string]any{"message_id": id, "date": 0, "chat": map[string]any{"id": chatID}})
+	case "sendMessage":
+		f.nextID++
+		reply(map[string]any{"message_id": f.nextID, "date": 0, "chat": map[string]any{"id": chatID}})
+	default:
+		http.Error(w, "unsupported method "+method, http.StatusNotFound)
+	}
+}
+
+// put 保存一个文件及对应的消息，返回 file_id，调用时需持有 f.mu
+func (f *fakeTelegram) put(data []byte) string {
+	f.nextID++
+	fileID := fmt.Sprintf("file%d", f.nextID)
+	f.files[fileID] = data
+	f.messages[f.nextID] = fileID
+	return fileID
+}
+
+// upload 直接在模拟的 Telegram 中放入一个文件，返回 file_id 和 message_id
+func (f *fakeTelegram) upload(data []byte) (string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.put(data), f.nextID
+}
+
+func (f *fakeTelegram) setFailSend(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failSend = fail
+}
+
+// failSends 让接下来的 n 次 sendDocument 返回错误
+func (f *fakeTelegram) failSends(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failNext = n
+}
+
+// setTooBig 让 getFile 对 fileID 返回超过下载限制的错误
+func (f *fakeTelegram) setTooBig(fileID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tooBig[fileID] = true
+}
+
+func (f *fakeTelegram) caption(messageID int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.captions[messageID]
+}
+
+// sentText 返回发送过的文档的说明文字和文件名，即 Telegram 中可以看到的内容
+func (f *fakeTelegram) sentText() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var text []string
+	for id, name := range f.names {
+		text = append(text, f.captions[id], name)
+	}
+	return text
+}
+
+func (f *fakeTelegram) deletedMessages() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.deleted...)
+}
+
+// redirectTransport 把发往 api.telegram.org 的请求转到模拟服务器
+type redirectTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == "api.telegram.org" {
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	}
+	return t.base.RoundTrip(r)
+}
+
+// setupTest 初始化测试用的文件目录、会话存储和模拟的 Telegram，ACCESS_PWD 为 "secret"
+func setupTest(t *testing.T) *fakeTelegram {
+	t.Helper()
+	tg := &fakeTelegram{files: map[string][]byte{}, messages: map[int]string{}, captions: map[int]string{}, names: map[int]string{}, tooBig: map[string]bool{}}
+	srv := httptest.NewServer(tg)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	transport := redirectTransport{target, &http.Transport{}}
+	oldTransport := http.DefaultTransport
+	http.DefaultTransport = transport
+	t.Cleanup(func() { http.DefaultTransport = oldTransport })
+
+	var err error
+	bot, err = tgbotapi.NewBotAPIWithClient("TOKEN", tgbotapi.APIEndpoint, &http.Client{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatID = 42
+	accessPwd = "secret"
+	defaultVisibility = visibilityPublic
+	authGuard = &AuthGuard{ips: make(map[string]*authFailures)}
+	telegramFileCache = sync.Map{}
+	signingSecret = []byte("0123456789abcdef0123456789abcdef")
+
+	dir := t.TempDir()
+	if catalog, err = openCatalog(filepath.Join(dir, "catalog.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { catalog.Close() })
+	if sessionStore, err = openSessionStore(filepath.Join(dir, "sessions")); err != nil {
+		t.Fatal(err)
+	}
+	if tusStore, err = openTusStore(filepath.Join(dir, "tus")); err != nil {
+		t.Fatal(err)
+	}
+	return tg
+}
+
+// serve 调用 handler 并返回响应
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	manifestVersion = 2
+	// sealedManifestVersion 加密清单的版本号，旧版本程序读取时会提示不支持的清单版本
+	sealedManifestVersion = 3
+	// manifestAAD 加密清单的附加认证数据，避免清单密文与分块密文互相替换
+	manifestAAD = "tg-disk manifest"
+	// manifestName 为 v2 清单文件名，legacyManifestName 为旧版纯文本清单
+	manifestName       = "fileAll.json"
+	legacyManifestName = "fileAll.txt"
+
+	// hashAlgChunks 整个文件的哈希算法：按顺序拼接各分块的 SHA-256 摘要后再做一次 SHA-256。
+	// 分块是并发上传的，服务端拿不到完整的字节流，因此无法直接计算整个文件的 SHA-256。
+	hashAlgChunks = "sha256-chunks"
+)
+
+// Manifest 大文件清单，记录文件信息及所有分块
+type Manifest struct {
+	Version     int         `json:"version"`
+	Filename    string      `json:"filename"`
+	Size        int64       `json:"size"`
+	ChunkSize   int64       `json:"chunk_size"`
+	MimeType    string      `json:"mime_type"`
+	HashAlg     string      `json:"hash_alg,omitempty"`
+	Hash        string      `json:"hash,omitempty"`
+	Encryption  string      `json:"encryption,omitempty"`  // 分块加密方案，为空表示明文
+	Compression string      `json:"compression,omitempty"` // 分块压缩算法，为空表示未压缩
+	CreatedAt   time.Time   `json:"created_at"`
+	Chunks      []ChunkInfo `json:"chunks"`
+}
+
+// SealedManifest 开启加密时发送到 Telegram 的清单：整个清单 JSON 加密保存，
+// 文件名、大小及各分块的明文哈希不会出现在 Telegram 中，只保留解密所需的密钥 ID 和 nonce；
+// 此时清单和分块消息的说明文字也不包含文件名，见 sendManifest、chunkCaption
+type SealedManifest struct {
+	Version    int    `json:"version"`
+	Encryption string `json:"encryption"`
+	KeyID      string `json:"key_id"`
+	Nonce      string `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// isManifestName 判断 Telegram 中的文件是否为清单文件
+func isManifestName(name string) bool {
+	return name == manifestName || name == legacyManifestName
+}
+
+// newManifest 根据分块列表生成 v2 清单，并计算总大小及整体哈希
+func newManifest(filename string, chunks []ChunkInfo) *Manifest {
+	m := &Manifest{
+		Version:   manifestVersion,
+		Filename:  filename,
+		MimeType:  mimeTypeOf(filename),
+		CreatedAt: time.Now(),
+		Chunks:    chunks,
+	}
+	if len(chunks) > 0 {
+		m.ChunkSize = chunks[0].Size
+	}
+	h := sha256.New()
+	hashed := true
+	for _, c := range chunks {
+		m.Size += c.Size
+		if c.KeyID != "" {
+			m.Encryption = encryptionScheme
+		}
+		if c.Compression != "" {
+			m.Compression = c.Compression
+		}
+		digest, err := hex.DecodeString(c.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			hashed = false
+			continue
+		}
+		h.Write(digest)
+	}
+	if hashed && len(chunks) > 0 {
+		m.HashAlg = hashAlgChunks
+		m.Hash = hex.EncodeToString(h.Sum(nil))
+	}
+	return m
+}
+
+// parseManifest 解析清单，兼容旧版 fileAll.txt（首行文件名，其余每行一个分块 file_id）
+func parseManifest(data []byte) (*Manifest, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		sealed := &SealedManifest{}
+		if err := json.Unmarshal(data, sealed); err == nil && sealed.Version == sealedManifestVersion {
+			plain, err := openBytes(sealed.KeyID, sealed.Nonce, sealed.Ciphertext, []byte(manifestAAD))
+			if err != nil {
+				return nil, fmt.Errorf("解密清单失败: %w", err)
+			}
+			return parseManifest(plain)
+		}
+		m := &Manifest{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("清单格式错误: %w", err)
+		}
+		if m.Version > manifestVersion {
+			return nil, fmt.Errorf("不支持的清单版本: %d", m.Version)
+		}
+		if m.Filename == "" || len(m.Chunks) == 0 {
+			return nil, errors.New("清单格式错误，缺少文件名或分块")
+		}
+		return m, nil
+	}
+
+	// 去掉空行
+	var cleanLines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			cleanLines = append(cleanLines, line)
+		}
+	}
+	if len(cleanLines) < 2 {
+		return nil, errors.New("fileAll.txt 格式错误，至少应有文件名和一个分块ID")
+	}
+	m := &Manifest{Version: 1, Filename: cleanLines[0], MimeType: mimeTypeOf(cleanLines[0])}
+	for _, fid := range cleanLines[1:] {
+		m.Chunks = append(m.Chunks, ChunkInfo{FileID: fid})
+	}
+	return m, nil
+}
+
+// fetchManifest 从 Telegram 下载并解析清单；旧版清单缺少分块大小时自动补全
+func fetchManifest(ctx context.Context, fileID string) (*Manifest, error) {
+	body, err := openBlob(ctx, fileID, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("下载清单失败: %w", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("读取清单失败: %w", err)
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	if m.Version < manifestVersion {
+		blobFileIDs := make([]string, len(m.Chunks))
+		for i, c := range m.Chunks {
+			blobFileIDs[i] = c.FileID
+		}
+		if m.Chunks, err = resolveChunkSizes(fileID, blobFileIDs); err != nil {
+			return nil, err
+		}
+		for _, c := range m.Chunks {
+			m.Size += c.Size
+		}
+	}
+	return m, nil
+}
+
+// encodeManifest 序列化清单，开启加密时整体加密为 SealedManifest
+func encodeManifest(m *Manifest) ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil || !encryptionEnabled() {
+		return data, err
+	}
+	sealed := &SealedManifest{Version: sealedManifestVersion, Encryption: encryptionScheme}
+	if sealed.KeyID, sealed.Nonce, sealed.Ciphertext, err = sealBytes(data, []byte(manifestAAD)); err != nil {
+		return nil, fmt.Errorf("加密清单失败: %w", err)
+	}
+	return json.MarshalIndent(sealed, "", "  ")
+}
+
+// sendManifest 将清单作为 fileAll.json 文档发送到 Telegram，说明文字为原始文件名（开启加密时没有说明）
+func sendManifest(m *Manifest) (*tgbotapi.Message, error) {
+	data, err := encodeManifest(m)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "merge_")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	metaPath := filepath.Join(tmpDir, manifestName)
+	if err := os.WriteFile(metaPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("写入 %s 失败: %w", manifestName, err)
+	}
+
+	metaDoc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(metaPath))
+	if !encryptionEnabled() {
+		metaDoc.Caption = m.Filename
+	}
+	msg, err := bot.Send(metaDoc)
+	if err != nil {
+		return nil, fmt.Errorf("上传 %s 失败: %w", manifestName, err)
+	}
+	if msg.Document == nil {
+		return nil, fmt.Errorf("上传 %s 失败: 未返回文件信息", manifestName)
+	}
+	return &msg, nil
+}
+
+// commitManifest 上传清单到 Telegram 并写入文件目录。写入失败（如目标路径已被占用）时删除刚发送的清单消息，
+// 分块仍保留在去重索引中，换个路径重新上传时可以直接复用
+func commitManifest(m *Manifest, dir, uploader string, vis Visibility) (*FileRecord, error) {
+	msg, err := sendManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	rec := &FileRecord{
+		Filename:   m.Filename,
+		Path:       dir,
+		Size:       m.Size,
+		MimeType:   m.MimeType,
+		FileID:     msg.Document.FileID,
+		MessageID:  msg.MessageID,
+		Chunked:    true,
+		Chunks:     m.Chunks,
+		Uploader:   uploader,
+		Visibility: vis,
+	}
+	if err := recordUpload(rec); err != nil {
+		if err := deleteMessage(msg.MessageID); err != nil {
+			log.Printf("删除清单消息 %d 失败: %v", msg.MessageID, err)
+		}
+		return nil, err
+	}
+	return rec, nil
+}
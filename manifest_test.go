@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withEncryptionKey 临时配置加密密钥，keyID 为空表示关闭加密
+func withEncryptionKey(t *testing.T, keyID string) {
+	t.Helper()
+	oldKeys, oldID := encryptionKeys, encryptionKeyID
+	t.Cleanup(func() { encryptionKeys, encryptionKeyID = oldKeys, oldID })
+	encryptionKeys, encryptionKeyID = map[string][]byte{}, ""
+	if keyID != "" {
+		if err := loadEncryptionKeys(keyID + ":" + strings.Repeat("A", 43) + "="); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncodeManifest(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	m := newManifest("secret-report.pdf", []ChunkInfo{{FileID: "c1", Size: 10, SHA256: sha}, {FileID: "c2", Size: 5, SHA256: sha}})
+
+	tests := []struct {
+		name   string
+		keyID  string
+		sealed bool
+	}{
+		{"未开启加密", "", false},
+		{"开启加密", "k1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEncryptionKey(t, tt.keyID)
+			data, err := encodeManifest(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaked := bytes.Contains(data, []byte("secret-report")) || bytes.Contains(data, []byte(sha))
+			if leaked == tt.sealed {
+				t.Fatalf("manifest leaks filename or chunk hashes: %v, want %v:\n%s", leaked, !tt.sealed, data)
+			}
+			got, err := parseManifest(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Filename != m.Filename || got.Size != 15 || len(got.Chunks) != 2 || got.Chunks[1].SHA256 != sha {
+				t.Errorf("parseManifest() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestParseSealedManifestErrors(t *testing.T) {
+	withEncryptionKey(t, "k1")
+	data, err := encodeManifest(newManifest("a.bin", []ChunkInfo{{FileID: "c1", Size: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := &SealedManifest{}
+	if err := json.Unmarshal(data, sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s SealedManifest) SealedManifest
+	}{
+		{"密文被篡改", func(s SealedManifest) SealedManifest {
+			s.Ciphertext = append([]byte(nil), s.Ciphertext...)
+			s.Ciphertext[0] ^= 1
+			return s
+		}},
+		{"未配置的密钥", func(s SealedManifest) SealedManifest {
+			s.KeyID = "k9"
+			return s
+		}},
+		{"nonce 格式错误", func(s SealedManifest) SealedManifest {
+			s.Nonce = "xyz"
+			return s
+		}},
+	}
+	for _, tt := range tests {
+		data, _ := json.Marshal(tt.modify(*sealed))
+		if _, err := parseManifest(data); err == nil {
+			t.Errorf("%s: parseManifest() succeeded", tt.name)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		filename string
+		chunks   int
+		wantErr  bool
+	}{
+		{"v2", `{"version":2,"filename":"a.bin","chunks":[{"file_id":"c1","size":3}]}`, "a.bin", 1, false},
+		{"旧版纯文本", "a.bin\nc1\n\nc2\n", "a.bin", 2, false},
+		{"不支持的版本", `{"version":9,"filename":"a.bin","chunks":[{"file_id":"c1"}]}`, "", 0, true},
+		{"缺少分块", `{"version":2,"filename":"a.bin","chunks":[]}`, "", 0, true},
+		{"纯文本缺少分块", "a.bin\n", "", 0, true},
+		{"JSON 格式错误", `{"version":`, "", 0, true},
+	}
+	for _, tt := range tests {
+		m, err := parseManifest([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseManifest() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (m.Filename != tt.filename || len(m.Chunks) != tt.chunks) {
+			t.Errorf("%s: parseManifest() = %s with %d chunks", tt.name, m.Filename, len(m.Chunks))
+		}
+	}
+}
+
+// 开启加密后，直接上传和分片上传的消息说明、文档文件名都不包含原始文件名
+func TestEncryptedCaptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyID   string
+		visible bool // Telegram 中能看到文件名
+	}{
+		{"未开启加密", "", true},
+		{"开启加密", "k1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := setupTest(t)
+			withEncryptionKey(t, tt.keyID)
+
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, _ := mw.CreateFormFile("file", "secret-report.txt")
+			fw.Write([]byte("hello"))
+			mw.Close()
+			r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.Header.Set("X-Access-Pwd", "secret")
+			if w := serve(http.HandlerFunc(handleUpload), r); w.Code != http.StatusOK {
+				t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+			}
+
+			r = httptest.NewRequest(http.MethodPost, "/upload_session", strings.NewReader("filename=secret-notes.bin&size=5"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("X-Access-Pwd", "secret")
+			w := serve(http.HandlerFunc(handleUploadSession), r)
+			var st SessionStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+				t.Fatalf("create session: status %d: %s", w.Code, w.Body)
+			}
+			body.Reset()
+			mw = multipart.NewWriter(&body)
+			mw.WriteField("session_id", st.SessionID)
+			mw.WriteField("chunk_index", "0")
+			fw, _ = mw.CreateFormFile("chunk", "blob")
+			fw.Write([]byte("notes"))
+			mw.Close()
+			r = httptest.NewRequest(http.MethodPost, "/upload_chunk", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.Header.Set("X-Access-Pwd", "secret")
+			if w := serve(http.HandlerFunc(handleUploadChunk), r); w.Code != http.StatusOK {
+				t.Fatalf("upload chunk: status %d: %s", w.Code, w.Body)
+			}
+			r = httptest.NewRequest(http.MethodPost, "/merge_chunks", strings.NewReader("session_id="+st.SessionID))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("X-Access-Pwd", "secret")
+			if w := serve(http.HandlerFunc(handleMergeChunks), r); w.Code != http.StatusOK {
+				t.Fatalf("merge: status %d: %s", w.Code, w.Body)
+			}
+
+			text := strings.Join(tg.sentText(), "\n")
+			for _, name := range []string{"secret-report", "secret-notes"} {
+				if strings.Contains(text, name) != tt.visible {
+					t.Errorf("%s visible in Telegram = %v, want %v:\n%s", name, !tt.visible, tt.visible, text)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDC 单点登录：网页通过身份提供方（IdP）的授权码流程登录（PKCE + nonce），校验 ID Token 后
+// 按用户名自动创建或更新账号（账号绑定 iss + sub），角色由 groups 声明映射，登录成功后下发与密码登录相同的会话 Cookie
+const (
+	oidcCookieName = "tgd_oidc"
+	oidcCookiePath = "/oidc/"
+	oidcStateTTL   = 10 * time.Minute // 从跳转到 IdP 到回调的最长时间
+	// oidcHTTPTimeout 请求 IdP discovery、公钥的超时时间
+	oidcHTTPTimeout = 30 * time.Second
+	oidcProvider    = "oidc"
+)
+
+var (
+	// oidcConf 为 nil 表示未配置 OIDC_ISSUER，不启用单点登录
+	oidcConf *OIDCConfig
+
+	errOIDCState    = errors.New("登录状态无效或已过期，请重新登录")
+	errOIDCNoRole   = errors.New("所在的用户组没有访问权限")
+	errOIDCUsername = errors.New("身份提供方返回的用户名不合法")
+	errOIDCEmail    = errors.New("邮箱未经身份提供方验证")
+	errOIDCLocal    = errors.New("用户名已被本地账号或其他单点登录用户占用")
+)
+
+// OIDCConfig 单点登录配置
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	UsernameClaim string          // 作为用户名的声明，默认 preferred_username
+	GroupsClaim   string          // 用户组声明，默认 groups
+	RoleMapping   map[string]Role // 用户组 -> 角色，属于多个组时取最高的角色
+	DefaultRole   Role            // 不属于任何映射组时的角色，为空表示拒绝登录
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// loadOIDCConfig 读取 OIDC_* 环境变量，未配置 OIDC_ISSUER 时返回 nil
+func loadOIDCConfig() (*OIDCConfig, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	c := &OIDCConfig{
+		Issuer:        issuer,
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.FieldsFunc(os.Getenv("OIDC_SCOPES"), func(r rune) bool { return r == ',' || r == ' ' }),
+		UsernameClaim: cmp.Or(os.Getenv("OIDC_USERNAME_CLAIM"), "preferred_username"),
+		GroupsClaim:   cmp.Or(os.Getenv("OIDC_GROUPS_CLAIM"), "groups"),
+		DefaultRole:   Role(os.Getenv("OIDC_DEFAULT_ROLE")),
+	}
+	if c.ClientID == "" {
+		return nil, errors.New("缺少 OIDC_CLIENT_ID")
+	}
+	if c.RedirectURL == "" {
+		if baseURL == "" {
+			return nil, errors.New("缺少 OIDC_REDIRECT_URL 或 BASE_URL")
+		}
+		c.RedirectURL = strings.TrimRight(baseURL, "/") + "/oidc/callback"
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	} else if !slices.Contains(c.Scopes, oidc.ScopeOpenID) {
+		c.Scopes = append([]string{oidc.ScopeOpenID}, c.Scopes...)
+	}
+	if c.DefaultRole != "" && c.DefaultRole.level() == 0 {
+		return nil, errors.New("OIDC_DEFAULT_ROLE 无效，可选 viewer、uploader、admin")
+	}
+	var err error
+	if c.RoleMapping, err = parseRoleMapping(os.Getenv("OIDC_ROLE_MAPPING")); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseRoleMapping 解析 "组=角色" 格式、逗号分隔的映射，如 "tg-admins=admin,devs=uploader"
+func parseRoleMapping(s string) (map[string]Role, error) {
+	mapping := make(map[string]Role)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(group) == "" || Role(strings.TrimSpace(role)).level() == 0 {
+			return nil, fmt.Errorf("无效的角色映射: %s", item)
+		}
+		mapping[strings.TrimSpace(group)] = Role(strings.TrimSpace(role))
+	}
+	return mapping, nil
+}
+
+// getProvider 读取 IdP 的 discovery 配置，成功后缓存；IdP 暂时不可用时下次登录再重试。
+// 之后刷新签名公钥时仍使用这里的 context，因此不能使用请求的 context
+func (c *OIDCConfig) getProvider() (*oidc.Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: oidcHTTPTimeout})
+	p, err := oidc.NewProvider(ctx, c.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	c.provider = p
+	return p, nil
+}
+
+func (c *OIDCConfig) oauth2Config(p *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  c.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       c.Scopes,
+	}
+}
+
+// mapRole 按用户组映射角色
+func (c *OIDCConfig) mapRole(groups []string) (Role, error) {
+	role := c.DefaultRole
+	for _, g := range groups {
+		if r, ok := c.RoleMapping[g]; ok && r.level() > role.level() {
+			role = r
+		}
+	}
+	if role == "" {
+		return "", errOIDCNoRole
+	}
+	return role, nil
+}
+
+// oidcState 跳转到 IdP 前保存在签名 Cookie 中的状态
+type oidcState struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"` // PKCE code_verifier
+	ExpiresAt int64  `json:"exp"`
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func setOIDCStateCookie(w http.ResponseWriter, r *http.Request, s *oidcState) {
+	data, _ := json.Marshal(s)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    payload + "." + loginMAC("oidc", payload),
+		Path:     oidcCookiePath,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   getScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// readOIDCState 校验并清除状态 Cookie
+func readOIDCState(w http.ResponseWriter, r *http.Request) (*oidcState, error) {
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return nil, errOIDCState
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: oidcCookiePath, MaxAge: -1, HttpOnly: true})
+	payload, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(loginMAC("oidc", payload))) {
+		return nil, errOIDCState
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errOIDCState
+	}
+	s := &oidcState{}
+	if json.Unmarshal(data, s) != nil || time.Now().Unix() > s.ExpiresAt {
+		return nil, errOIDCState
+	}
+	return s, nil
+}
+
+// handleOIDCLogin GET /oidc/login 跳转到身份提供方
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcConf == nil {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := oidcConf.getProvider()
+	if err != nil {
+		log.Println("读取 OIDC 配置失败:", err)
+		http.Error(w, "连接身份提供方失败: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	s := &oidcState{
+		State:     randomString(),
+		Nonce:     randomString(),
+		Verifier:  oauth2.GenerateVerifier(),
+		ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+	}
+	setOIDCStateCookie(w, r, s)
+	link := oidcConf.oauth2Config(p).AuthCodeURL(s.State, oauth2.S256ChallengeOption(s.Verifier), oidc.Nonce(s.Nonce))
+	http.Redirect(w, r, link, http.StatusFound)
+}
+
+// handleOIDCCallback GET /oidc/callback 用授权码换取并校验 ID Token，登录成功后跳转到上传页面
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcConf == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s, err := readOIDCState(w, r)
+	if err == nil && !hmac.Equal([]byte(r.URL.Query().Get("state")), []byte(s.State)) {
+		err = errOIDCState
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "身份提供方拒绝登录: "+e+" "+r.URL.Query().Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+	p, err := oidcConf.getProvider()
+	if err != nil {
+		http.Error(w, "连接身份提供方失败: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	token, err := oidcConf.oauth2Config(p).Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(s.Verifier))
+	if err != nil {
+		log.Println("OIDC 授权码换取令牌失败:", err)
+		http.Error(w, "登录失败: 授权码无效", http.StatusUnauthorized)
+		return
+	}
+	rawID, _ := token.Extra("id_token").(string)
+	if rawID == "" {
+		http.Error(w, "登录失败: 身份提供方未返回 ID Token", http.StatusBadGateway)
+		return
+	}
+	idToken, err := p.Verifier(&oidc.Config{ClientID: oidcConf.ClientID}).Verify(r.Context(), rawID)
+	if err == nil && !hmac.Equal([]byte(idToken.Nonce), []byte(s.Nonce)) {
+		err = errors.New("nonce 不匹配")
+	}
+	if err != nil {
+		log.Println("OIDC ID Token 校验失败:", err)
+		http.Error(w, "登录失败: ID Token 无效", http.StatusUnauthorized)
+		return
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "登录失败: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	u, err := oidcUser(idToken.Issuer, idToken.Subject, claims)
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, errOIDCLocal) {
+			status = http.StatusConflict
+		}
+		http.Error(w, "登录失败: "+err.Error(), status)
+		return
+	}
+	if err := startLoginSession(w, r, u); err != nil {
+		http.Error(w, "创建登录会话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("用户 %s 通过 OIDC 登录，角色: %s，IP: %s", u.Username, u.Role, clientIP(r))
+	http.Redirect(w, r, "/upload.html", http.StatusFound)
+}
+
+// claimStrings 读取字符串或字符串数组类型的声明
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// oidcUser 按 ID Token 的声明创建或更新用户：首次登录时自动创建并绑定 issuer、subject，
+// 之后只有同一 IdP 的同一用户能登录该账号，每次登录按用户组同步角色。
+// 用户名取自邮箱时要求 email_verified，且不同域名的同名邮箱会映射到同一用户名，后登录的会被拒绝
+func oidcUser(issuer, subject string, claims map[string]any) (*User, error) {
+	name, _ := claims[oidcConf.UsernameClaim].(string)
+	if oidcConf.UsernameClaim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return nil, errOIDCEmail
+		}
+		name, _, _ = strings.Cut(name, "@")
+	}
+	name = strings.ToLower(name)
+	if !usernamePattern.MatchString(name) {
+		return nil, errOIDCUsername
+	}
+	role, err := oidcConf.mapRole(claimStrings(claims[oidcConf.GroupsClaim]))
+	if err != nil {
+		return nil, err
+	}
+	u, err := catalog.UpdateUser(name, func(u *User) error {
+		if u.Provider != oidcProvider || u.Issuer != issuer || u.Subject != subject {
+			return errOIDCLocal
+		}
+		if u.Disabled {
+			return errUserDisabled
+		}
+		u.Role = role
+		return nil
+	})
+	if errors.Is(err, errOIDCLocal) {
+		log.Printf("OIDC 用户 %s (iss: %s, sub: %s) 的用户名与已有账号冲突，拒绝登录", name, issuer, subject)
+	}
+	if !errors.Is(err, errUserNotFound) {
+		return u, err
+	}
+	u = &User{
+		Username:  name,
+		Role:      role,
+		Provider:  oidcProvider,
+		Issuer:    issuer,
+		Subject:   subject,
+		CreatedAt: time.Now(),
+	}
+	if err := catalog.CreateUser(u); err != nil {
+		return nil, err
+	}
+	log.Printf("通过 OIDC 创建用户 %s (%s)", u.Username, u.Role)
+	return u, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRoleMapping(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]Role
+		wantErr bool
+	}{
+		{"", map[string]Role{}, false},
+		{"tg-admins=admin, devs=uploader", map[string]Role{"tg-admins": roleAdmin, "devs": roleUploader}, false},
+		{" staff = viewer ,", map[string]Role{"staff": roleViewer}, false},
+		{"devs", nil, true},
+		{"=admin", nil, true},
+		{"devs=root", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRoleMapping(tt.in)
+		if (err != nil) != tt.wantErr || (err == nil && !maps.Equal(got, tt.want)) {
+			t.Errorf("parseRoleMapping(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestOIDCMapRole(t *testing.T) {
+	mapping := map[string]Role{"admins": roleAdmin, "devs": roleUploader}
+	tests := []struct {
+		groups      []string
+		defaultRole Role
+		want        Role
+		wantErr     bool
+	}{
+		{[]string{"devs"}, "", roleUploader, false},
+		{[]string{"devs", "admins"}, "", roleAdmin, false},
+		{[]string{"other"}, "", "", true},
+		{nil, "", "", true},
+		{[]string{"other"}, roleViewer, roleViewer, false},
+		{[]string{"devs"}, roleAdmin, roleAdmin, false},
+	}
+	for _, tt := range tests {
+		c := &OIDCConfig{RoleMapping: mapping, DefaultRole: tt.defaultRole}
+		got, err := c.mapRole(tt.groups)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("mapRole(%v) with default %q = %q, %v; want %q, error %v", tt.groups, tt.defaultRole, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// testIdP 模拟身份提供方：discovery、JWKS、授权（要求 PKCE S256）和令牌接口，令牌接口校验 code_verifier
+// 并返回 RS256 签名的 ID Token
+type testIdP struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	nonce     string
+	claims    map[string]any // 附加到 ID Token 的声明
+	badNonce  bool
+}
+
+const testIdPCode = "code-1"
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testIdP{key: key}
+	mux := http.NewServeMux()
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	issuer := m.srv.URL
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/authorize",
+			"token_endpoint":                        issuer + "/token",
+			"jwks_uri":                              issuer + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA", "kid": "k1", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" {
+			http.Error(w, "missing PKCE or nonce", http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.challenge, m.nonce = q.Get("code_challenge"), q.Get("nonce")
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+testIdPCode+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != testIdPCode || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		claims := map[string]any{"iss": issuer, "aud": "tg-disk", "iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(), "nonce": m.nonce}
+		if m.badNonce {
+			claims["nonce"] = "other"
+		}
+		maps.Copy(claims, m.claims)
+		writeJSON(w, map[string]any{"access_token": "at", "token_type": "Bearer", "id_token": m.sign(claims)})
+	})
+	return m
+}
+
+// sign 生成 RS256 签名的 JWT
+func (m *testIdP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(input))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// oidcLogin 走完一次 /oidc/login -> IdP 授权 -> /oidc/callback，tamper 为 "state"、"code" 时篡改回调参数
+func oidcLogin(t *testing.T, mux http.Handler, tamper string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(mux, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("/oidc/login: status %d: %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := callback.Query()
+	switch tamper {
+	case "state":
+		q.Set("state", q.Get("state")+"x")
+	case "code":
+		q.Set("code", "forged")
+	}
+	r := httptest.NewRequest(http.MethodGet, callback.Path+"?"+q.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return serve(mux, r)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	tests := []struct {
+		name          string
+		usernameClaim string
+		existing      func(issuer string) *User // 登录前已有的账号
+		claims        map[string]any
+		tamper        string
+		badNonce      bool
+		status        int
+		user          string // 登录成功后的用户名
+		role          Role
+	}{
+		{name: "首次登录创建账号",
+			claims: map[string]any{"sub": "s-1", "preferred_username": "Carol", "groups": []string{"devs", "admins"}},
+			status: http.StatusFound, user: "carol", role: roleAdmin},
+		{name: "按用户组同步角色",
+			existing: func(iss string) *User {
+				return &User{Username: "carol", Role: roleAdmin, Provider: oidcProvider, Issuer: iss, Subject: "s-1"}
+			},
+			claims: map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": "devs"},
+			status: http.StatusFound, user: "carol", role: roleUploader},
+		{name: "没有映射的用户组",
+			claims: map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": []string{"other"}},
+			status: http.StatusForbidden},
+		{name: "state 被篡改",
+			claims: map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": "devs"},
+			tamper: "state", status: http.StatusBadRequest},
+		{name: "授权码无效",
+			claims: map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": "devs"},
+			tamper: "code", status: http.StatusUnauthorized},
+		{name: "nonce 不匹配",
+			claims:   map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": "devs"},
+			badNonce: true, status: http.StatusUnauthorized},
+		{name: "同名的其他 IdP 用户",
+			existing: func(iss string) *User {
+				return &User{Username: "carol", Role: roleAdmin, Provider: oidcProvider, Issuer: iss, Subject: "s-2"}
+			},
+			claims: map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": "devs"},
+			status: http.StatusConflict},
+		{name: "其他 IdP 的相同 sub",
+			existing: func(string) *User {
+				return &User{Username: "carol", Role: roleAdmin, Provider: oidcProvider, Issuer: "https://other.example.com", Subject: "s-1"}
+			},
+			claims: map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": "devs"},
+			status: http.StatusConflict},
+		{name: "同名的本地账号",
+			existing: func(string) *User { return &User{Username: "dave", Role: roleViewer, PasswordHash: "x"} },
+			claims:   map[string]any{"sub": "s-3", "preferred_username": "dave", "groups": "devs"},
+			status:   http.StatusConflict},
+		{name: "账号已停用",
+			existing: func(iss string) *User {
+				return &User{Username: "carol", Role: roleAdmin, Provider: oidcProvider, Issuer: iss, Subject: "s-1", Disabled: true}
+			},
+			claims: map[string]any{"sub": "s-1", "preferred_username": "carol", "groups": "devs"},
+			status: http.StatusForbidden},
+		{name: "用户名不合法",
+			claims: map[string]any{"sub": "s-1", "preferred_username": "../admin", "groups": "devs"},
+			status: http.StatusForbidden},
+		{name: "邮箱作为用户名", usernameClaim: "email",
+			claims: map[string]any{"sub": "s-1", "email": "Alice@a.example.com", "email_verified": true, "groups": "devs"},
+			status: http.StatusFound, user: "alice", role: roleUploader},
+		{name: "邮箱未验证", usernameClaim: "email",
+			claims: map[string]any{"sub": "s-1", "email": "alice@a.example.com", "groups": "devs"},
+			status: http.StatusForbidden},
+		{name: "其他域名的同名邮箱", usernameClaim: "email",
+			existing: func(iss string) *User {
+				return &User{Username: "alice", Role: roleUploader, Provider: oidcProvider, Issuer: iss, Subject: "s-1"}
+			},
+			claims: map[string]any{"sub": "s-2", "email": "alice@b.example.com", "email_verified": true, "groups": "devs"},
+			status: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			idp := newTestIdP(t)
+			t.Setenv("OIDC_ISSUER", idp.srv.URL)
+			t.Setenv("OIDC_CLIENT_ID", "tg-disk")
+			t.Setenv("OIDC_CLIENT_SECRET", "client-secret")
+			t.Setenv("OIDC_REDIRECT_URL", "http://tg-disk.example.com/oidc/callback")
+			t.Setenv("OIDC_USERNAME_CLAIM", tt.usernameClaim)
+			t.Setenv("OIDC_ROLE_MAPPING", "admins=admin,devs=uploader")
+			var err error
+			if oidcConf, err = loadOIDCConfig(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { oidcConf = nil })
+			if tt.existing != nil {
+				if err := catalog.CreateUser(tt.existing(idp.srv.URL)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			idp.claims, idp.badNonce = tt.claims, tt.badNonce
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /oidc/login", handleOIDCLogin)
+			mux.HandleFunc("GET /oidc/callback", handleOIDCCallback)
+			w := oidcLogin(t, mux, tt.tamper)
+			if w.Code != tt.status {
+				t.Fatalf("callback: status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var session *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == loginCookieName && c.Value != "" {
+					session = c
+				}
+			}
+			if tt.user == "" {
+				if session != nil {
+					t.Error("login cookie issued for a rejected login")
+				}
+				return
+			}
+			if session == nil {
+				t.Fatal("no login cookie")
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+			r.AddCookie(session)
+			u, err := authenticate(r)
+			if err != nil {
+				t.Fatalf("authenticate with login cookie: %v", err)
+			}
+			if u.Username != tt.user || u.Role != tt.role || u.Issuer != idp.srv.URL || u.Subject != tt.claims["sub"] {
+				t.Errorf("user = %s (%s, iss %s, sub %s), want %s (%s, iss %s, sub %v)",
+					u.Username, u.Role, u.Issuer, u.Subject, tt.user, tt.role, idp.srv.URL, tt.claims["sub"])
+			}
+			if strings.Contains(w.Header().Get("Location"), "oidc") {
+				t.Errorf("redirected to %s after login", w.Header().Get("Location"))
+			}
+		})
+	}
+}
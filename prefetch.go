@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// downloadBufferMB 预取缓冲区的内存上限（MB），超过单槽配额的分块（压缩、加密的分块按密文与原文合计）会落盘到临时文件
+var downloadBufferMB = 128
+
+const fetchRetries = 3
+
+// blobBuffer 保存一个已下载完成、等待按顺序写出的分块片段，off/n 为需要写出的区间
+type blobBuffer struct {
+	data   []byte
+	file   *os.File
+	off, n int64
+}
+
+func (b *blobBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.file == nil {
+		n, err := w.Write(b.data[b.off : b.off+b.n])
+		return int64(n), err
+	}
+	return io.Copy(w, io.NewSectionReader(b.file, b.off, b.n))
+}
+
+func (b *blobBuffer) Close() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+type fetchResult struct {
+	buf *blobBuffer
+	err error
+}
+
+// fetchSegment 下载一个分块片段，小于 memLimit 的放内存，否则写入临时文件，失败时重试
+func fetchSegment(ctx context.Context, seg blobSegment, memLimit int64, decodeSlot chan struct{}) (*blobBuffer, error) {
+	var lastErr error
+	for attempt := 1; attempt <= fetchRetries; attempt++ {
+		buf, err := fetchSegmentOnce(ctx, seg, memLimit, decodeSlot)
+		if err == nil {
+			return buf, nil
+		}
+		lastErr = err
+		var integrityErr *integrityError
+		if ctx.Err() != nil || errors.As(err, &integrityErr) {
+			break
+		}
+		log.Printf("下载分块 %d 失败（第 %d 次）: %v", seg.index+1, attempt, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+	return nil, lastErr
+}
+
+func fetchSegmentOnce(ctx context.Context, seg blobSegment, memLimit int64, decodeSlot chan struct{}) (*blobBuffer, error) {
+	if encodedChunk(seg.chunk) {
+		return fetchEncodedSegment(ctx, seg, memLimit, decodeSlot)
+	}
+	// 有哈希时下载整个分块以便校验，再截取所需区间
+	offset, length := seg.offset, seg.length
+	if seg.sha256 != "" {
+		offset, length = 0, seg.chunkSize
+	}
+	body, err := openBlob(ctx, seg.fileID, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	buf := &blobBuffer{off: seg.offset - offset, n: seg.length}
+	hasher := sha256.New()
+	var written int64
+	if length <= memLimit {
+		var b bytes.Buffer
+		b.Grow(int(length))
+		written, err = io.Copy(io.MultiWriter(&b, hasher), body)
+		buf.data = b.Bytes()
+	} else {
+		buf.file, err = os.CreateTemp("", "blob_")
+		if err != nil {
+			return nil, err
+		}
+		written, err = io.Copy(io.MultiWriter(buf.file, hasher), body)
+	}
+	if err == nil && written != length {
+		err = fmt.Errorf("数据不完整: %d/%d 字节", written, length)
+	}
+	if err == nil && seg.sha256 != "" {
+		if actual := hex.EncodeToString(hasher.Sum(nil)); actual != seg.sha256 {
+			err = &integrityError{index: seg.index, fileID: seg.fileID, expected: seg.sha256, actual: actual}
+		}
+	}
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// fetchEncodedSegment 下载整个压缩或加密的分块，还原、校验原始内容的哈希后截取所需区间，
+// 超过 memLimit 的分块所需区间同样写入临时文件
+func fetchEncodedSegment(ctx context.Context, seg blobSegment, memLimit int64, decodeSlot chan struct{}) (*blobBuffer, error) {
+	data, release, err := downloadEncoded(ctx, seg.fileID, seg.chunk, memLimit, decodeSlot)
+	if err != nil {
+		return nil, err
+	}
+	if release != nil {
+		defer release()
+	}
+	plain, err := decodeSegment(seg, data)
+	if err != nil {
+		return nil, err
+	}
+	if release == nil {
+		return &blobBuffer{data: plain, off: seg.offset, n: seg.length}, nil
+	}
+	buf := &blobBuffer{n: seg.length}
+	if buf.file, err = os.CreateTemp("", "blob_"); err != nil {
+		return nil, err
+	}
+	if _, err := buf.file.Write(plain[seg.offset : seg.offset+seg.length]); err != nil {
+		buf.Close()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// downloadEncoded 下载整个压缩或加密的分块 c。GCM 需要完整密文才能认证，解压也只能从头开始，
+// 因此还原时整个分块必须在内存中：密文与原文合计不超过 memLimit 时直接读入内存，release 为 nil；
+// 否则先把密文写入临时文件，取得 decodeSlot 后再读入内存，保证同一次下载或校验中只有一个这样的分块占用内存，
+// 调用方还原完成后调用 release 释放
+func downloadEncoded(ctx context.Context, fileID string, c ChunkInfo, memLimit int64, decodeSlot chan struct{}) (data []byte, release func(), err error) {
+	stored := storedSize(c)
+	body, err := openBlob(ctx, fileID, 0, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	if stored+c.Size <= memLimit {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if int64(len(data)) != stored {
+			return nil, nil, fmt.Errorf("数据不完整: %d/%d 字节", len(data), stored)
+		}
+		return data, nil, nil
+	}
+
+	tmp, err := os.CreateTemp("", "blob_")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	written, err := io.Copy(tmp, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if written != stored {
+		return nil, nil, fmt.Errorf("数据不完整: %d/%d 字节", written, stored)
+	}
+	select {
+	case decodeSlot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	data = make([]byte, stored)
+	if _, err := tmp.ReadAt(data, 0); err != nil {
+		<-decodeSlot
+		return nil, nil, err
+	}
+	return data, func() { <-decodeSlot }, nil
+}
+
+// decodeSegment 还原分块并校验原始内容的哈希
+func decodeSegment(seg blobSegment, data []byte) ([]byte, error) {
+	plain, err := decodeChunk(seg.chunk, data)
+	if err != nil {
+		return nil, &integrityError{index: seg.index, fileID: seg.fileID, expected: seg.sha256, actual: err.Error()}
+	}
+	if seg.sha256 != "" {
+		sum := sha256.Sum256(plain)
+		if actual := hex.EncodeToString(sum[:]); actual != seg.sha256 {
+			return nil, &integrityError{index: seg.index, fileID: seg.fileID, expected: seg.sha256, actual: actual}
+		}
+	}
+	return plain, nil
+}
+
+// prefetchSegments 使用 workers 个并发预取分块片段，最多领先写出位置 workers 个分块，
+// 结果按原始顺序通过 write 写出。ctx 取消（如客户端断开）时中止所有未完成的下载。
+func prefetchSegments(ctx context.Context, segments []blobSegment, workers int, write func(blobSegment, *blobBuffer) error) error {
+	if len(segments) == 0 {
+		return nil
+	}
+	workers = max(1, min(workers, len(segments)))
+	memLimit := int64(downloadBufferMB) << 20 / int64(workers)
+	// 超过 memLimit 的压缩、加密分块同时只还原一个
+	decodeSlot := make(chan struct{}, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// window 控制预取窗口：写出一个分块后才允许再启动一个下载
+	window := make(chan struct{}, workers)
+	slots := make([]chan fetchResult, len(segments))
+	for i := range slots {
+		slots[i] = make(chan fetchResult, 1)
+	}
+
+	var wg sync.WaitGroup
+	producerDone := make(chan struct{})
+	go func() {
+		defer close(producerDone)
+		for i, seg := range segments {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			wg.Add(1)
+			go func(slot chan<- fetchResult, seg blobSegment) {
+				defer wg.Done()
+				buf, err := fetchSegment(ctx, seg, memLimit, decodeSlot)
+				slot <- fetchResult{buf: buf, err: err}
+			}(slots[i], seg)
+		}
+	}()
+
+	defer func() {
+		// 清理已下载但未写出的缓冲（取消后 worker 会很快返回）
+		cancel()
+		go func() {
+			<-producerDone
+			wg.Wait()
+			for _, slot := range slots {
+				select {
+				case res := <-slot:
+					if res.buf != nil {
+						res.buf.Close()
+					}
+				default:
+				}
+			}
+		}()
+	}()
+
+	for i, seg := range segments {
+		var res fetchResult
+		select {
+		case res = <-slots[i]:
+		case <-ctx.Done():
+			return fmt.Errorf("客户端已断开: %w", ctx.Err())
+		}
+		if res.err != nil {
+			return fmt.Errorf("下载分块 %d 失败: %w", seg.index+1, res.err)
+		}
+		err := write(seg, res.buf)
+		res.buf.Close()
+		if err != nil {
+			return err
+		}
+		<-window
+	}
+	return nil
+}
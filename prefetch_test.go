@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testChunk 按 alg 压缩、按 encrypt 加密 plain 后放入模拟的 Telegram，返回对应的分块信息
+func testChunk(t *testing.T, tg *fakeTelegram, plain []byte, alg string, encrypt bool) ChunkInfo {
+	t.Helper()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "plain")
+	if err := os.WriteFile(src, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(plain)
+	c := ChunkInfo{Size: int64(len(plain)), SHA256: hex.EncodeToString(sum[:])}
+	if alg != "" {
+		dst := filepath.Join(dir, "compressed")
+		if _, err := compressFile(src, dst, alg); err != nil {
+			t.Fatal(err)
+		}
+		src, c.Compression = dst, alg
+	}
+	if encrypt {
+		dst := filepath.Join(dir, "encrypted")
+		var err error
+		if c.KeyID, c.Nonce, err = encryptFile(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		src = dst
+	}
+	stored, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StoredSize = int64(len(stored))
+	c.FileID, c.MessageID = tg.upload(stored)
+	return c
+}
+
+// 压缩、加密的分块超过单槽内存配额时写入临时文件，否则放在内存中
+func TestFetchEncodedSegment(t *testing.T) {
+	tg := setupTest(t)
+	withEncryptionKey(t, "k1")
+	plain := bytes.Repeat([]byte("tg-disk prefetch "), 4096)
+	size := int64(len(plain))
+	tests := []struct {
+		name           string
+		alg            string
+		encrypt        bool
+		memLimit       int64
+		offset, length int64
+		inFile         bool
+	}{
+		{"压缩分块在内存中", compressionZstd, false, 4 * size, 0, size, false},
+		{"压缩分块超过配额", compressionGzip, false, size, 100, 1000, true},
+		{"加密分块在内存中", "", true, 4 * size, 10, size - 10, false},
+		{"加密分块超过配额", "", true, size, 0, size, true},
+		{"压缩且加密的分块超过配额", compressionZstd, true, size / 2, size - 5, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testChunk(t, tg, plain, tt.alg, tt.encrypt)
+			seg := blobSegment{fileID: c.FileID, offset: tt.offset, length: tt.length, chunkSize: c.Size, sha256: c.SHA256, chunk: c}
+			buf, err := fetchEncodedSegment(context.Background(), seg, tt.memLimit, make(chan struct{}, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer buf.Close()
+			if (buf.file != nil) != tt.inFile {
+				t.Errorf("buffered in file = %v, want %v", buf.file != nil, tt.inFile)
+			}
+			var out bytes.Buffer
+			if _, err := buf.WriteTo(&out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), plain[tt.offset:tt.offset+tt.length]) {
+				t.Errorf("got %d bytes, want plain[%d:%d]", out.Len(), tt.offset, tt.offset+tt.length)
+			}
+		})
+	}
+}
+
+func TestFetchEncodedSegmentIntegrity(t *testing.T) {
+	tg := setupTest(t)
+	withEncryptionKey(t, "k1")
+	plain := bytes.Repeat([]byte("0123456789"), 1000)
+	tests := []struct {
+		name     string
+		memLimit int64
+		tamper   func(c *ChunkInfo)
+	}{
+		{"哈希不匹配", 1 << 20, func(c *ChunkInfo) { c.SHA256 = hex.EncodeToString(make([]byte, 32)) }},
+		{"哈希不匹配超过配额", 100, func(c *ChunkInfo) { c.SHA256 = hex.EncodeToString(make([]byte, 32)) }},
+		{"nonce 错误", 1 << 20, func(c *ChunkInfo) { c.Nonce = hex.EncodeToString(make([]byte, 12)) }},
+		{"nonce 错误超过配额", 100, func(c *ChunkInfo) { c.Nonce = hex.EncodeToString(make([]byte, 12)) }},
+	}
+	for _, tt := range tests {
+		c := testChunk(t, tg, plain, compressionGzip, true)
+		tt.tamper(&c)
+		seg := blobSegment{fileID: c.FileID, length: c.Size, chunkSize: c.Size, sha256: c.SHA256, chunk: c}
+		var integrityErr *integrityError
+		if _, err := fetchEncodedSegment(context.Background(), seg, tt.memLimit, make(chan struct{}, 1)); !errors.As(err, &integrityErr) {
+			t.Errorf("%s: error = %v, want integrity error", tt.name, err)
+		}
+	}
+}
+
+// 多个超过配额的加密分块并发预取时仍按顺序完整写出
+func TestPrefetchEncodedSegments(t *testing.T) {
+	tg := setupTest(t)
+	withEncryptionKey(t, "k1")
+	oldBuffer := downloadBufferMB
+	downloadBufferMB = 1
+	t.Cleanup(func() { downloadBufferMB = oldBuffer })
+
+	var want bytes.Buffer
+	var segments []blobSegment
+	for i := range 6 {
+		plain := bytes.Repeat([]byte{byte('a' + i)}, 300<<10)
+		c := testChunk(t, tg, plain, "", true)
+		segments = append(segments, blobSegment{index: i, fileID: c.FileID, length: c.Size, chunkSize: c.Size, sha256: c.SHA256, chunk: c})
+		want.Write(plain)
+	}
+	var got bytes.Buffer
+	err := prefetchSegments(context.Background(), segments, 4, func(seg blobSegment, buf *blobBuffer) error {
+		if buf.file == nil {
+			t.Errorf("segment %d buffered in memory, exceeds the %d MB buffer", seg.index, downloadBufferMB)
+		}
+		_, err := buf.WriteTo(&got)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("got %d bytes, want %d", got.Len(), want.Len())
+	}
+}
+
+// 超过配额的分块占用 decodeSlot 直到 release，期间其他超过配额的分块等待，配额内的分块不受影响
+func TestDownloadEncodedSlot(t *testing.T) {
+	tg := setupTest(t)
+	withEncryptionKey(t, "k1")
+	plain := bytes.Repeat([]byte("0123456789"), 1000)
+	c := testChunk(t, tg, plain, "", true)
+	slot := make(chan struct{}, 1)
+
+	data, release, err := downloadEncoded(context.Background(), c.FileID, c, 100, slot)
+	if err != nil || release == nil {
+		t.Fatalf("downloadEncoded() = %d bytes, release %v, %v; want release", len(data), release != nil, err)
+	}
+	if int64(len(data)) != c.StoredSize {
+		t.Errorf("got %d bytes, want %d", len(data), c.StoredSize)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := downloadEncoded(ctx, c.FileID, c, 100, slot); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second chunk over the limit: error = %v, want to wait for the slot", err)
+	}
+	if _, release, err := downloadEncoded(context.Background(), c.FileID, c, 1<<20, slot); err != nil || release != nil {
+		t.Errorf("chunk within the limit: release %v, %v; want in memory", release != nil, err)
+	}
+
+	release()
+	_, release, err = downloadEncoded(context.Background(), c.FileID, c, 100, slot)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	release()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	publicIDLength   = 10
+	publicIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// newPublicID 生成 10 位 base62 随机 ID
+func newPublicID() string {
+	b := make([]byte, publicIDLength)
+	base := big.NewInt(int64(len(publicIDAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, base)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = publicIDAlphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+// assignPublicIDTx 为还没有公开 ID 的记录分配一个未被占用的公开 ID，并写入索引
+func assignPublicIDTx(tx *bolt.Tx, rec *FileRecord) error {
+	if rec.PublicID != "" {
+		return nil
+	}
+	public := tx.Bucket(bucketPublic)
+	for {
+		id := newPublicID()
+		if public.Get([]byte(id)) == nil {
+			rec.PublicID = id
+			return public.Put([]byte(id), []byte(rec.ID))
+		}
+	}
+}
+
+// reindexPublicIDsTx 为旧版本写入的记录补充公开 ID
+func reindexPublicIDsTx(tx *bolt.Tx) error {
+	files := tx.Bucket(bucketFiles)
+	var legacy []*FileRecord
+	err := files.ForEach(func(_, v []byte) error {
+		rec := &FileRecord{}
+		if err := json.Unmarshal(v, rec); err != nil {
+			return err
+		}
+		if rec.PublicID == "" {
+			legacy = append(legacy, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, rec := range legacy {
+		if err := assignPublicIDTx(tx, rec); err != nil {
+			return err
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := files.Put([]byte(rec.ID), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFileByPublicID 按公开 ID 查询文件
+func (c *Catalog) GetFileByPublicID(publicID string) (*FileRecord, error) {
+	var rec *FileRecord
+	err := c.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketPublic).Get([]byte(publicID))
+		if id == nil {
+			return errFileNotFound
+		}
+		data := tx.Bucket(bucketFiles).Get(id)
+		if data == nil {
+			return errFileNotFound
+		}
+		rec = &FileRecord{}
+		return json.Unmarshal(data, rec)
+	})
+	return rec, err
+}
+
+// fileLink 文件的下载链接 /f/{public_id}，开启 REQUIRE_SIGNED_URLS 时带签名；没有公开 ID 时退回 /d 链接
+func fileLink(base string, rec *FileRecord) string {
+	if requireSignedURLs {
+		link, _ := signedFileLink(base, rec, signedURLTTL)
+		return link
+	}
+	if rec.PublicID == "" {
+		return downloadLink(base, rec.FileID, recordFilename(rec))
+	}
+	return strings.TrimRight(base, "/") + "/f/" + rec.PublicID
+}
+
+// manifestLink 分块上传完成后的下载链接：优先使用文件目录中记录的公开 ID，找不到记录时退回 /d 清单链接
+func manifestLink(base, recordID, fileID string) string {
+	if rec, err := catalog.GetFile(recordID); err == nil {
+		return fileLink(base, rec)
+	}
+	return downloadLink(base, fileID, "")
+}
+
+// recordFilename 按 /d 的约定返回 filename 参数：单文件为文件名，分块文件为空（表示 file_id 是清单）
+func recordFilename(rec *FileRecord) string {
+	if rec.Chunked {
+		return ""
+	}
+	return rec.Filename
+}
+
+// handlePublicDownload GET /f/{id}，按公开 ID 下载文件
+func handlePublicDownload(w http.ResponseWriter, r *http.Request) {
+	publicID := r.PathValue("id")
+	if err := verifySignature(r.URL.Query(), publicID, ""); err != nil {
+		writeSignatureError(w, err)
+		return
+	}
+	rec, err := catalog.GetFileByPublicID(publicID)
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	if !authorizeDownload(w, r, []*FileRecord{rec}, true) {
+		return
+	}
+	serveFile(w, r, rec.FileID, recordFilename(rec))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordFilename(t *testing.T) {
+	tests := []struct {
+		rec  FileRecord
+		want string
+	}{
+		{FileRecord{Filename: "a.txt"}, "a.txt"},
+		{FileRecord{Filename: "big.iso", Chunked: true}, ""},
+	}
+	for _, tt := range tests {
+		if got := recordFilename(&tt.rec); got != tt.want {
+			t.Errorf("recordFilename(%+v) = %q, want %q", tt.rec, got, tt.want)
+		}
+	}
+}
+
+// 文件超过 Bot API 下载限制时的错误页面要转义文件名和 Host
+func TestPublicDownloadTooBigEscapes(t *testing.T) {
+	tg := setupTest(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /f/{id}", handlePublicDownload)
+
+	tests := []struct {
+		filename string
+		host     string
+		want     []string
+	}{
+		{"report.pdf", "example.com", []string{"report.pdf", "http://example.com"}},
+		{`<script>alert(1)</script>.txt`, "example.com", []string{"&lt;script&gt;alert(1)&lt;/script&gt;.txt"}},
+		{`a"b'&c.txt`, `evil.com"><img src=x>`, []string{"a&#34;b&#39;&amp;c.txt", "evil.com&#34;&gt;&lt;img src=x&gt;"}},
+	}
+	for _, tt := range tests {
+		fileID, messageID := tg.upload([]byte("x"))
+		tg.setTooBig(fileID)
+		rec := &FileRecord{FileID: fileID, MessageID: messageID, Filename: tt.filename, Size: 1, Path: "/" + fileID}
+		if err := catalog.PutFile(rec); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/f/"+rec.PublicID, nil)
+		r.Host = tt.host
+		w := serve(mux, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d, want %d: %s", tt.filename, w.Code, http.StatusBadRequest, w.Body)
+		}
+		body := w.Body.String()
+		if strings.Contains(body, "<script>") || strings.Contains(body, "<img") {
+			t.Errorf("%s: unescaped markup in error page", tt.filename)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: error page missing %q", tt.filename, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var (
+	errInvalidRange = errors.New("Range 格式错误")
+	errNoOverlap    = errors.New("Range 超出文件范围")
+)
+
+// httpRange 表示一个字节区间 [start, start+length)
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange 解析 Range 请求头（RFC 7233），返回空切片表示无 Range
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		startStr, endStr, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		startStr, endStr = textproto.TrimString(startStr), textproto.TrimString(endStr)
+		var r httpRange
+		if startStr == "" {
+			// bytes=-N 表示最后 N 个字节
+			if endStr == "" || endStr[0] == '-' {
+				return nil, errInvalidRange
+			}
+			i, err := strconv.ParseInt(endStr, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errInvalidRange
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if endStr == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(endStr, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errInvalidRange
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return
+}
+
+// rangesMIMESize 计算 multipart/byteranges 响应体的总长度
+func rangesMIMESize(ranges []httpRange, contentType string, size int64) (encSize int64) {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, size))
+		encSize += ra.length
+	}
+	mw.Close()
+	encSize += int64(w)
+	return
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// blobSegment 表示某个分块中需要读取的一段数据
+type blobSegment struct {
+	index  int
+	fileID string
+	offset int64
+	length int64
+	// 分块的完整大小及 SHA-256，有哈希时会下载整个分块校验后再截取
+	chunkSize int64
+	sha256    string
+	// 压缩或加密的分块总是下载整块，还原后再截取
+	chunk ChunkInfo
+}
+
+// segmentsFor 将文件内的字节区间映射到对应的分块及分块内偏移
+func segmentsFor(chunks []ChunkInfo, ra httpRange) []blobSegment {
+	var segments []blobSegment
+	start, end := ra.start, ra.start+ra.length
+	var pos int64
+	for i, c := range chunks {
+		chunkStart, chunkEnd := pos, pos+c.Size
+		pos = chunkEnd
+		if chunkEnd <= start || chunkStart >= end {
+			continue
+		}
+		segStart, segEnd := max(start, chunkStart), min(end, chunkEnd)
+		segments = append(segments, blobSegment{
+			index:     i,
+			fileID:    c.FileID,
+			offset:    segStart - chunkStart,
+			length:    segEnd - segStart,
+			chunkSize: c.Size,
+			sha256:    c.SHA256,
+			chunk:     c,
+		})
+	}
+	return segments
+}
+
+// serveRanges 根据 Range 请求头返回完整文件（200）、单区间（206）或多区间 multipart/byteranges（206），
+// 调用前需设置好 Content-Disposition 等其余响应头
+func serveRanges(w http.ResponseWriter, r *http.Request, contentType string, chunks []ChunkInfo) error {
+	var size int64
+	for _, c := range chunks {
+		size += c.Size
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	rangeHeader := r.Header.Get("Range")
+	if ir := r.Header.Get("If-Range"); ir != "" && ir != w.Header().Get("ETag") && ir != w.Header().Get("Last-Modified") {
+		// 资源已变化，忽略 Range 返回完整内容
+		rangeHeader = ""
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		if errors.Is(err, errNoOverlap) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		}
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+	// 区间总和超过文件大小时视为无效的 Range，直接返回完整文件
+	if sumRangesSize(ranges) > size {
+		ranges = nil
+	}
+
+	status := http.StatusOK
+	sendRanges := []httpRange{{start: 0, length: size}}
+	var mw *multipart.Writer
+	switch {
+	case len(ranges) == 1:
+		status = http.StatusPartialContent
+		sendRanges = ranges
+		w.Header().Set("Content-Range", ranges[0].contentRange(size))
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+	case len(ranges) > 1:
+		status = http.StatusPartialContent
+		sendRanges = ranges
+		mw = multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.Header().Set("Content-Length", strconv.FormatInt(rangesMIMESize(ranges, contentType, size), 10))
+	default:
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	for _, ra := range sendRanges {
+		var dst io.Writer = w
+		if mw != nil {
+			part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+			if err != nil {
+				return err
+			}
+			dst = part
+		}
+		if err := writeChunkRange(r.Context(), w, dst, chunks, ra); err != nil {
+			return err
+		}
+	}
+	if mw != nil {
+		return mw.Close()
+	}
+	return nil
+}
+
+// writeChunkRange 并发预取区间涉及的分块片段，并按顺序写给客户端
+func writeChunkRange(ctx context.Context, w http.ResponseWriter, dst io.Writer, chunks []ChunkInfo, ra httpRange) error {
+	flusher, _ := w.(http.Flusher)
+	return prefetchSegments(ctx, segmentsFor(chunks, ra), downloadThreads, func(seg blobSegment, buf *blobBuffer) error {
+		written, err := buf.WriteTo(dst)
+		if err != nil {
+			return fmt.Errorf("传输分块 %d 失败: %w", seg.index+1, err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		log.Printf("已传输分块 %d/%d，大小: %d 字节", seg.index+1, len(chunks), written)
+		return nil
+	})
+}
+
+// checkNotModified 处理 If-None-Match / If-Modified-Since，命中时返回 304
+func checkNotModified(w http.ResponseWriter, r *http.Request, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(textproto.TrimString(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				writeNotModified(w)
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modTime.Truncate(time.Second).After(t) {
+			writeNotModified(w)
+			return true
+		}
+	}
+	return false
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Disposition")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// Telegram 返回的文件下载路径至少有效 1 小时，这里缓存以减少 GetFile 调用
+const telegramFileTTL = 50 * time.Minute
+
+type cachedTelegramFile struct {
+	file    tgbotapi.File
+	expires time.Time
+}
+
+var telegramFileCache sync.Map // file_id -> cachedTelegramFile
+
+// getTelegramFile 调用 GetFile 获取文件信息（带缓存）
+func getTelegramFile(fileID string) (tgbotapi.File, error) {
+	if v, ok := telegramFileCache.Load(fileID); ok {
+		if cached := v.(cachedTelegramFile); time.Now().Before(cached.expires) {
+			return cached.file, nil
+		}
+	}
+	tgFile, err := bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return tgFile, err
+	}
+	telegramFileCache.Store(fileID, cachedTelegramFile{file: tgFile, expires: time.Now().Add(telegramFileTTL)})
+	return tgFile, nil
+}
+
+// openBlob 打开 Telegram 上某个文件的一段数据，优先使用 Range 请求
+func openBlob(ctx context.Context, fileID string, offset, length int64) (io.ReadCloser, error) {
+	tgFile, err := getTelegramFile(fileID)
+	if err != nil {
+		return nil, err
+	}
+	blobURL := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", bot.Token, tgFile.FilePath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = resp.Body
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// 上游不支持 Range 时手动跳过
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("状态码异常: %d", resp.StatusCode)
+	}
+	if length >= 0 {
+		body = io.LimitReader(body, length)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}, nil
+}
+
+// fetchChunkSizes 通过 GetFile 并发获取各分块的大小
+func fetchChunkSizes(blobFileIDs []string) ([]ChunkInfo, error) {
+	chunks := make([]ChunkInfo, len(blobFileIDs))
+	errs := make([]error, len(blobFileIDs))
+	sem := make(chan struct{}, downloadThreads)
+	var wg sync.WaitGroup
+	for i, fid := range blobFileIDs {
+		wg.Add(1)
+		go func(i int, fid string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			tgFile, err := getTelegramFile(fid)
+			if err != nil {
+				errs[i] = fmt.Errorf("获取分块 %d 信息失败: %w", i+1, err)
+				return
+			}
+			chunks[i] = ChunkInfo{FileID: fid, Size: int64(tgFile.FileSize)}
+		}(i, fid)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// resolveChunkSizes 补全旧版清单的分块大小：优先使用文件目录中的记录，缺失时通过 GetFile 获取并回写目录
+func resolveChunkSizes(manifestFileID string, blobFileIDs []string) ([]ChunkInfo, error) {
+	rec, err := catalog.GetFile(manifestFileID)
+	if err == nil && len(rec.Chunks) == len(blobFileIDs) && chunkSizesKnown(rec.Chunks) {
+		return rec.Chunks, nil
+	}
+
+	chunks, err := fetchChunkSizes(blobFileIDs)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		rec.Chunks = chunks
+		if rec.Size == 0 {
+			for _, c := range chunks {
+				rec.Size += c.Size
+			}
+		}
+		if err := recordUpload(rec); err != nil {
+			log.Printf("回写 %s 的分块大小失败: %v", rec.Filename, err)
+		}
+	}
+	return chunks, nil
+}
+
+func chunkSizesKnown(chunks []ChunkInfo) bool {
+	for _, c := range chunks {
+		if c.Size <= 0 {
+			return false
+		}
+	}
+	return true
+}
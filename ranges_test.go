@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []httpRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"bytes=0-99", []httpRange{{0, 100}}, nil},
+		{"bytes=10-", []httpRange{{10, 990}}, nil},
+		{"bytes=-100", []httpRange{{900, 100}}, nil},
+		{"bytes=-2000", []httpRange{{0, 1000}}, nil},
+		{"bytes=990-5000", []httpRange{{990, 10}}, nil},
+		{"bytes=0-0, -1", []httpRange{{0, 1}, {999, 1}}, nil},
+		{"bytes= 1-2 ,, 5-6", []httpRange{{1, 2}, {5, 2}}, nil},
+		{"bytes=1000-", nil, errNoOverlap},
+		{"bytes=1000-,2000-3000", nil, errNoOverlap},
+		{"bytes=1000-,0-0", []httpRange{{0, 1}}, nil},
+		{"items=0-1", nil, errInvalidRange},
+		{"bytes=5", nil, errInvalidRange},
+		{"bytes=5-4", nil, errInvalidRange},
+		{"bytes=-", nil, errInvalidRange},
+		{"bytes=--5", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"bytes=-1-2", nil, errInvalidRange},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, 1000)
+		if !errors.Is(err, tt.err) || !slices.Equal(got, tt.want) {
+			t.Errorf("parseRange(%q) = %v, %v; want %v, %v", tt.header, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSegmentsFor(t *testing.T) {
+	chunks := []ChunkInfo{{FileID: "a", Size: 4}, {FileID: "b", Size: 4}, {FileID: "c", Size: 2}}
+	type seg struct {
+		fileID         string
+		offset, length int64
+	}
+	tests := []struct {
+		ra   httpRange
+		want []seg
+	}{
+		{httpRange{0, 10}, []seg{{"a", 0, 4}, {"b", 0, 4}, {"c", 0, 2}}},
+		{httpRange{2, 4}, []seg{{"a", 2, 2}, {"b", 0, 2}}},
+		{httpRange{4, 4}, []seg{{"b", 0, 4}}},
+		{httpRange{9, 1}, []seg{{"c", 1, 1}}},
+		{httpRange{3, 6}, []seg{{"a", 3, 1}, {"b", 0, 4}, {"c", 0, 1}}},
+	}
+	for _, tt := range tests {
+		var got []seg
+		for _, s := range segmentsFor(chunks, tt.ra) {
+			got = append(got, seg{s.fileID, s.offset, s.length})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("segmentsFor(%v) = %v, want %v", tt.ra, got, tt.want)
+		}
+	}
+}
+
+func TestServeRanges(t *testing.T) {
+	tg := setupTest(t)
+	var chunks []ChunkInfo
+	for _, data := range []string{"0123", "4567", "89"} {
+		fileID, _ := tg.upload([]byte(data))
+		chunks = append(chunks, ChunkInfo{FileID: fileID, Size: int64(len(data))})
+	}
+	tests := []struct {
+		method       string
+		header       string
+		status       int
+		contentRange string
+		body         string
+		parts        []string // multipart/byteranges 各部分的内容
+	}{
+		{http.MethodGet, "", http.StatusOK, "", "0123456789", nil},
+		{http.MethodGet, "bytes=2-5", http.StatusPartialContent, "bytes 2-5/10", "2345", nil},
+		{http.MethodGet, "bytes=-3", http.StatusPartialContent, "bytes 7-9/10", "789", nil},
+		{http.MethodGet, "bytes=0-0,8-", http.StatusPartialContent, "", "", []string{"0", "89"}},
+		{http.MethodGet, "bytes=10-", http.StatusRequestedRangeNotSatisfiable, "bytes */10", "", nil},
+		{http.MethodGet, "bytes=x", http.StatusRequestedRangeNotSatisfiable, "", "", nil},
+		{http.MethodGet, "bytes=0-,0-,0-", http.StatusOK, "", "0123456789", nil}, // 区间总和超过文件大小
+		{http.MethodHead, "bytes=2-5", http.StatusPartialContent, "bytes 2-5/10", "", nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/d", nil)
+		if tt.header != "" {
+			r.Header.Set("Range", tt.header)
+		}
+		w := httptest.NewRecorder()
+		if err := serveRanges(w, r, "text/plain", chunks); err != nil {
+			t.Fatalf("%s %q: %v", tt.method, tt.header, err)
+		}
+		if w.Code != tt.status || w.Header().Get("Content-Range") != tt.contentRange {
+			t.Errorf("%s %q: status %d, Content-Range %q; want %d, %q", tt.method, tt.header, w.Code, w.Header().Get("Content-Range"), tt.status, tt.contentRange)
+			continue
+		}
+		if tt.parts == nil {
+			if w.Code != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != tt.body {
+				t.Errorf("%s %q: body %q, want %q", tt.method, tt.header, w.Body, tt.body)
+			}
+			continue
+		}
+		_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := w.Body.Len(); w.Header().Get("Content-Length") != strconv.Itoa(n) {
+			t.Errorf("%q: Content-Length %s, body %d bytes", tt.header, w.Header().Get("Content-Length"), n)
+		}
+		mr := multipart.NewReader(w.Body, params["boundary"])
+		var parts []string
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(p)
+			parts = append(parts, string(data))
+		}
+		if strings.Join(parts, "|") != strings.Join(tt.parts, "|") {
+			t.Errorf("%q: parts %q, want %q", tt.header, parts, tt.parts)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// renameFile 重命名文件，无需重新上传：单文件修改消息的说明文字（消息被其他记录共用时只修改文件目录）；
+// 分块文件重新发送一份新的清单并删除旧清单消息，旧 file_id 记为别名，旧链接通过 /d 跳转到新链接
+func renameFile(ctx context.Context, rec *FileRecord, name string) (*FileRecord, error) {
+	name = strings.TrimSpace(name)
+	if !validName(name) {
+		return nil, errInvalidPath
+	}
+	if name == rec.Filename {
+		return rec, nil
+	}
+	if catalog.PathExists(path.Join(rec.Path, name)) {
+		return nil, errPathExists
+	}
+
+	if !rec.Chunked {
+		if rec.MessageID != 0 {
+			// 秒传的其他记录共用同一条消息时不修改说明，以免改掉其他文件在 Telegram 中显示的名称
+			refs, err := collectBlobRefs(rec.ID, time.Time{})
+			if err != nil {
+				return nil, fmt.Errorf("读取文件目录失败: %w", err)
+			}
+			if !refs.has(ChunkInfo{FileID: rec.FileID, MessageID: rec.MessageID}) {
+				_, err := bot.Request(tgbotapi.NewEditMessageCaption(chatID, rec.MessageID, name))
+				if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+					return nil, fmt.Errorf("修改消息说明失败: %w", err)
+				}
+			}
+		}
+		return catalog.RenameFile(rec.ID, name, rec.FileID, rec.MessageID)
+	}
+
+	m, err := fetchManifest(ctx, rec.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Version < manifestVersion {
+		// 旧版清单顺便升级为 v2
+		m = newManifest(name, m.Chunks)
+	}
+	m.Filename, m.MimeType = name, mimeTypeOf(name)
+	msg, err := sendManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := catalog.RenameFile(rec.ID, name, msg.Document.FileID, msg.MessageID)
+	if err != nil {
+		if err := deleteMessage(msg.MessageID); err != nil {
+			log.Printf("删除新清单消息 %d 失败: %v", msg.MessageID, err)
+		}
+		return nil, err
+	}
+	if err := deleteMessage(rec.MessageID); err != nil {
+		log.Printf("删除旧清单消息 %d 失败: %v", rec.MessageID, err)
+	}
+	log.Printf("重命名文件 %s -> %s", rec.Filename, name)
+	return updated, nil
+}
+
+// handleRenameFile POST /api/files/{id}/rename，参数 name（新文件名）
+func handleRenameFile(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	rec, err := getUserFile(u, r.PathValue("id"))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	rec, err = renameFile(r.Context(), rec, r.FormValue("name"))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, u.viewFile(rec))
+}
+
+// redirectRenamed 旧链接（重命名前的 file_id 或文件名）跳转到文件当前的下载链接。
+// recs 为 FilesByFileID 的结果；秒传的多条记录共用 file_id 时无法确定链接对应哪一条，不跳转
+func redirectRenamed(w http.ResponseWriter, r *http.Request, recs []*FileRecord, fileID, filename string) bool {
+	if len(recs) != 1 {
+		return false
+	}
+	rec := recs[0]
+	if rec.FileID == fileID && (rec.Chunked || filename == "" || filename == rec.Filename) {
+		return false
+	}
+	query := r.URL.Query()
+	query.Set("file_id", rec.FileID)
+	if rec.Chunked {
+		query.Del("filename")
+	} else {
+		query.Set("filename", rec.Filename)
+	}
+	if query.Get("sig") != "" {
+		// 签名已校验过，按原有效期为新链接重新签名
+		exp, _ := strconv.ParseInt(query.Get("exp"), 10, 64)
+		signQuery(query, exp)
+	}
+	http.Redirect(w, r, "/d?"+query.Encode(), http.StatusMovedPermanently)
+	return true
+}
+
+// handleRenameCommand 机器人命令：回复文件消息 /rename 新文件名
+func handleRenameCommand(msg *tgbotapi.Message) {
+	reply := func(text string) {
+		if _, err := bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text)); err != nil {
+			log.Println(err)
+		}
+	}
+	name := strings.TrimSpace(msg.CommandArguments())
+	if name == "" {
+		reply("用法：回复文件消息 /rename 新文件名")
+		return
+	}
+	fileID, _ := replyFile(msg.ReplyToMessage)
+	rec, err := catalog.GetFile(fileID)
+	if err != nil {
+		reply("文件不在文件目录中，无法重命名")
+		return
+	}
+	oldName := rec.Filename
+	if _, err := renameFile(context.Background(), rec, name); err != nil {
+		reply(fmt.Sprintf("重命名 [%s] 失败: %v", oldName, err))
+		return
+	}
+	reply(fmt.Sprintf("✏️文件 [%s] 已重命名为 [%s]", oldName, name))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// 重命名单文件时修改消息说明，消息被秒传的其他记录共用时不修改
+func TestRenameFileCaption(t *testing.T) {
+	tests := []struct {
+		name    string
+		shared  bool
+		caption string // 重命名后消息的说明
+	}{
+		{"独占消息", false, "b.txt"},
+		{"共用消息", true, "a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := setupTest(t)
+			fileID, messageID := tg.upload([]byte("hello"))
+			tg.captions[messageID] = "a.txt"
+			rec := &FileRecord{FileID: fileID, MessageID: messageID, Filename: "a.txt", Size: 5, Path: "/"}
+			if err := catalog.PutFile(rec); err != nil {
+				t.Fatal(err)
+			}
+			if tt.shared {
+				if err := catalog.PutFile(&FileRecord{FileID: fileID, MessageID: messageID, Filename: "a.txt", Size: 5, Path: "/copy"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			updated, err := renameFile(context.Background(), rec, "b.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Filename != "b.txt" {
+				t.Errorf("filename = %q, want b.txt", updated.Filename)
+			}
+			if got := tg.caption(messageID); got != tt.caption {
+				t.Errorf("caption = %q, want %q", got, tt.caption)
+			}
+		})
+	}
+}
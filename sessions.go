@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 分片上传会话：由服务端记录每个分片的上传结果，合并时校验完整性、顺序和大小，
+// 状态持久化在 DATA_DIR/sessions 下，服务重启后客户端可查询缺失的分片继续上传。
+var sessionStore *SessionStore
+
+const (
+	// maxChunkSize Telegram Bot API 上传文件的大小上限
+	maxChunkSize = 50 << 20
+	// minChunkSize、maxSessionChunks 限制自定义的 chunk_size 及分片数，避免极小的分片让会话状态无限膨胀
+	minChunkSize     = 64 << 10
+	maxSessionChunks = 10000
+)
+
+// UploadSession 一次分片上传
+type UploadSession struct {
+	ID        string      `json:"id"`
+	Filename  string      `json:"filename"`
+	Path      string      `json:"path"`
+	Size      int64       `json:"size"`
+	ChunkSize int64       `json:"chunk_size"`
+	Chunks    []ChunkInfo `json:"chunks"` // 按分片序号存放，FileID 为空表示尚未收到
+	// Replaced 同一序号被重复上传时被替换下来的旧分片，等待清理
+	Replaced []ChunkInfo `json:"replaced,omitempty"`
+	NoDedup  bool        `json:"no_dedup,omitempty"` // 创建时指定 dedup=0，所有分块都重新发送
+	// Visibility 创建时指定的文件可见性，为空时使用默认值
+	Visibility Visibility `json:"visibility,omitempty"`
+	Uploader   string     `json:"uploader"`
+	Owner      string     `json:"owner,omitempty"` // 创建会话的用户，使用 ACCESS_PWD 时为空
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	// 合并完成后对应的文件目录记录
+	FileRecordID string `json:"file_record_id,omitempty"`
+	FileID       string `json:"file_id,omitempty"`
+}
+
+func (s *UploadSession) totalChunks() int {
+	return len(s.Chunks)
+}
+
+// expectedChunkSize 第 index 个分片应有的大小，最后一个分片为剩余部分
+func (s *UploadSession) expectedChunkSize(index int) int64 {
+	if index == len(s.Chunks)-1 {
+		return s.Size - s.ChunkSize*int64(index)
+	}
+	return s.ChunkSize
+}
+
+// missing 返回尚未收到的分片序号
+func (s *UploadSession) missing() []int {
+	missing := []int{}
+	for i, c := range s.Chunks {
+		if c.FileID == "" {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// SessionStore 管理分片上传会话的持久化
+type SessionStore struct {
+	*stateDir
+}
+
+func openSessionStore(dir string) (*SessionStore, error) {
+	d, err := newStateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionStore{d}, nil
+}
+
+func (s *SessionStore) Load(id string) (*UploadSession, error) {
+	sess := &UploadSession{}
+	if err := s.load(id, sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (s *SessionStore) Save(sess *UploadSession) error {
+	sess.UpdatedAt = time.Now()
+	return s.save(sess.ID, sess)
+}
+
+// Update 在会话锁内加载、修改并保存会话
+func (s *SessionStore) Update(id string, fn func(*UploadSession) error) (*UploadSession, error) {
+	unlock := s.lock(id)
+	defer unlock()
+	sess, err := s.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(sess); err != nil {
+		return sess, err
+	}
+	return sess, s.Save(sess)
+}
+
+// sameChunks 两组分块的大小和 SHA-256 完全一致
+func sameChunks(a, b []ChunkInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].SHA256 == "" || a[i].SHA256 != b[i].SHA256 || a[i].Size != b[i].Size {
+			return false
+		}
+	}
+	return true
+}
+
+// SessionStatus 会话状态查询结果
+type SessionStatus struct {
+	SessionID   string `json:"session_id"`
+	Filename    string `json:"filename"`
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	ChunkSize   int64  `json:"chunk_size"`
+	TotalChunks int    `json:"total_chunks"`
+	Received    int    `json:"received"`
+	Missing     []int  `json:"missing"`
+	Completed   bool   `json:"completed"`
+	FileID      string `json:"file_id,omitempty"`
+}
+
+// status 会话状态，路径相对于用户 u 的根目录
+func (s *UploadSession) status(u *User) SessionStatus {
+	missing := s.missing()
+	return SessionStatus{
+		SessionID:   s.ID,
+		Filename:    s.Filename,
+		Path:        u.rel(s.Path),
+		Size:        s.Size,
+		ChunkSize:   s.ChunkSize,
+		TotalChunks: s.totalChunks(),
+		Received:    s.totalChunks() - len(missing),
+		Missing:     missing,
+		Completed:   s.FileID != "",
+		FileID:      s.FileID,
+	}
+}
+
+// handleUploadSession POST 创建分片上传会话，GET 查询会话状态（含缺失的分片）
+func handleUploadSession(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		sess, err := sessionStore.Load(r.FormValue("session_id"))
+		if err != nil || !u.canAccessUpload(sess.Owner) {
+			http.Error(w, "上传会话不存在", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, sess.status(u))
+	case http.MethodPost:
+		createUploadSession(w, r, u)
+	default:
+		http.Error(w, "只支持 GET 或 POST", http.StatusMethodNotAllowed)
+	}
+}
+
+func createUploadSession(w http.ResponseWriter, r *http.Request, u *User) {
+	filename := r.FormValue("filename")
+	if !validName(filename) {
+		http.Error(w, "缺少 filename 参数或文件名不合法", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, "size 参数无效", http.StatusBadRequest)
+		return
+	}
+	chunkSize := uploadChunkSize()
+	if v := r.FormValue("chunk_size"); v != "" {
+		limit := int64(maxChunkSize)
+		if encryptionEnabled() {
+			limit -= encryptionOverhead
+		}
+		chunkSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || chunkSize < minChunkSize || chunkSize > limit {
+			http.Error(w, fmt.Sprintf("chunk_size 参数无效，应在 %d ~ %d 字节之间", minChunkSize, limit), http.StatusBadRequest)
+			return
+		}
+	}
+	total := (size-1)/chunkSize + 1
+	if total > maxSessionChunks {
+		http.Error(w, fmt.Sprintf("分片数 %d 超过上限 %d，请增大 chunk_size", total, maxSessionChunks), http.StatusBadRequest)
+		return
+	}
+	vis, ok := uploadVisibility(w, r)
+	if !ok {
+		return
+	}
+	dir := u.abs(r.FormValue("path"))
+	// 同名文件大小相同时可能是重复上传的相同内容，留到合并时按分块哈希判断
+	if existing, err := catalog.GetFileByPath(path.Join(dir, filename)); err == nil && existing.Size != size {
+		http.Error(w, "目标路径已存在同名文件", http.StatusConflict)
+		return
+	}
+
+	sess := &UploadSession{
+		ID:         newID(),
+		Filename:   filename,
+		Path:       dir,
+		Size:       size,
+		ChunkSize:  chunkSize,
+		Chunks:     make([]ChunkInfo, total),
+		NoDedup:    !dedupRequested(r),
+		Uploader:   u.actor(),
+		Owner:      u.Username,
+		Visibility: vis,
+		CreatedAt:  time.Now(),
+	}
+	if err := sessionStore.Save(sess); err != nil {
+		http.Error(w, "保存上传会话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("创建上传会话 %s: %s，大小 %d 字节，共 %d 个分片", sess.ID, filename, size, sess.totalChunks())
+	writeJSON(w, sess.status(u))
+}
+
+// handleUploadChunk handles single chunk upload within an upload session
+func handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持 POST", http.StatusMethodNotAllowed)
+		return
+	}
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+
+	sess, err := sessionStore.Load(r.FormValue("session_id"))
+	if err != nil || !u.canAccessUpload(sess.Owner) {
+		http.Error(w, "上传会话不存在，请先调用 /upload_session 创建", http.StatusNotFound)
+		return
+	}
+	if sess.FileID != "" {
+		http.Error(w, "上传会话已完成", http.StatusConflict)
+		return
+	}
+	index, err := strconv.Atoi(r.FormValue("chunk_index"))
+	if err != nil || index < 0 || index >= sess.totalChunks() {
+		http.Error(w, fmt.Sprintf("chunk_index 无效，应在 0 ~ %d 之间", sess.totalChunks()-1), http.StatusBadRequest)
+		return
+	}
+
+	chunk, _, err := r.FormFile("chunk")
+	if err != nil {
+		http.Error(w, "读取分片失败: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer chunk.Close()
+
+	tmpDir, err := os.MkdirTemp("", "chunk_")
+	if err != nil {
+		http.Error(w, "创建临时目录失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	chunkPath := filepath.Join(tmpDir, "blob")
+	tmp, err := os.Create(chunkPath)
+	if err != nil {
+		http.Error(w, "创建临时文件失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tmp.Close()
+
+	written, err := tmp.ReadFrom(chunk)
+	if err != nil {
+		http.Error(w, "写入临时文件失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmp.Close()
+
+	if expected := sess.expectedChunkSize(index); written != expected {
+		http.Error(w, fmt.Sprintf("分片 %d 大小错误: %d 字节，应为 %d 字节", index, written, expected), http.StatusBadRequest)
+		return
+	}
+
+	// Upload chunk to Telegram, caption carries chunk info
+	dedup := !sess.NoDedup && dedupRequested(r)
+	info, err := sendChunkFile(chunkPath, chunkCaption(index, sess.totalChunks(), sess.Filename), sess.Filename, dedup)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	completed := false
+	_, err = sessionStore.Update(sess.ID, func(sess *UploadSession) error {
+		if sess.FileID != "" {
+			// 发送分片期间会话已被合并，新分片不会被清单引用，交给孤儿分块回收
+			completed = true
+			sess.Replaced = append(sess.Replaced, info)
+			return nil
+		}
+		if old := sess.Chunks[index]; old.FileID != "" && old.FileID != info.FileID {
+			sess.Replaced = append(sess.Replaced, old)
+		}
+		sess.Chunks[index] = info
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "保存上传会话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if completed {
+		http.Error(w, "上传会话已完成", http.StatusConflict)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// handleMergeChunks 校验会话中的分片完整、大小正确后，生成 fileAll.json 清单并上传到 Telegram
+func handleMergeChunks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持 POST", http.StatusMethodNotAllowed)
+		return
+	}
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+
+	sessionID := r.FormValue("session_id")
+	if sessionID == "" {
+		http.Error(w, "缺少 session_id 参数", http.StatusBadRequest)
+		return
+	}
+
+	errIncomplete := errors.New("分片不完整")
+	status := http.StatusInternalServerError // 读取、保存会话失败
+	sess, err := sessionStore.Update(sessionID, func(sess *UploadSession) error {
+		if !u.canAccessUpload(sess.Owner) {
+			return os.ErrNotExist
+		}
+		if sess.FileID != "" {
+			// 重复合并直接返回已有结果
+			return nil
+		}
+		if len(sess.missing()) > 0 {
+			return errIncomplete
+		}
+		var total int64
+		for i, c := range sess.Chunks {
+			if c.Size != sess.expectedChunkSize(i) {
+				status = http.StatusBadRequest
+				return fmt.Errorf("分片 %d 大小错误: %d 字节，应为 %d 字节", i, c.Size, sess.expectedChunkSize(i))
+			}
+			total += c.Size
+		}
+		if total != sess.Size {
+			status = http.StatusBadRequest
+			return fmt.Errorf("分片总大小 %d 与文件大小 %d 不一致", total, sess.Size)
+		}
+		if existing, err := catalog.GetFileByPath(path.Join(sess.Path, sess.Filename)); err == nil {
+			// 同一路径已有内容完全相同的文件（如重复上传同一个构建产物），直接返回已有文件
+			if !sameChunks(existing.Chunks, sess.Chunks) {
+				return errPathExists
+			}
+			applyUploadVisibility(existing, sess.Visibility)
+			sess.FileRecordID, sess.FileID = existing.ID, existing.FileID
+			log.Printf("上传会话 %s 与已有文件 %s 内容相同，不再生成清单", sess.ID, existing.FullPath())
+			return nil
+		}
+
+		rec, err := commitManifest(newManifest(sess.Filename, sess.Chunks), sess.Path, sess.Uploader, sess.Visibility)
+		if err != nil {
+			// 目录写入失败时 errPathExists 在下面映射为 409，其余视为发送清单失败
+			status = http.StatusBadGateway
+			return err
+		}
+		sess.FileRecordID, sess.FileID = rec.ID, rec.FileID
+		log.Printf("上传会话 %s 合并完成: %s", sess.ID, sess.Filename)
+		return nil
+	})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "上传会话不存在", http.StatusNotFound)
+		return
+	case errors.Is(err, errIncomplete):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, sess.status(u))
+		return
+	case errors.Is(err, errPathExists):
+		http.Error(w, "目标路径已存在同名文件", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// 大文件直接使用流式下载
+	downloadURL := manifestLink(getScheme(r)+"://"+r.Host, sess.FileRecordID, sess.FileID)
+
+	result := UploadResult{
+		Filename:    sess.Filename,
+		FileID:      sess.FileID,
+		DownloadURL: downloadURL,
+	}
+	writeJSON(w, result)
+}
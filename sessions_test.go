@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// postForm 以 ACCESS_PWD 身份提交表单
+func postForm(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Access-Pwd", "secret")
+	return serve(handler, r)
+}
+
+// postChunk 上传会话中的一个分片
+func postChunk(t *testing.T, sessionID string, index int, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("session_id", sessionID)
+	mw.WriteField("chunk_index", strconv.Itoa(index))
+	fw, _ := mw.CreateFormFile("chunk", "blob")
+	fw.Write(data)
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload_chunk", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("X-Access-Pwd", "secret")
+	return serve(http.HandlerFunc(handleUploadChunk), r)
+}
+
+func TestCreateUploadSessionLimits(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		name      string
+		size      string
+		chunkSize string
+		want      int
+		chunks    int
+	}{
+		{"默认分片大小", "100", "", http.StatusOK, 1},
+		{"最小分片大小", "200000", strconv.Itoa(minChunkSize), http.StatusOK, 4},
+		{"分片过小", "100", "1", http.StatusBadRequest, 0},
+		{"分片过大", "100", strconv.Itoa(maxChunkSize + 1), http.StatusBadRequest, 0},
+		{"分片数超过上限", strconv.Itoa(minChunkSize*maxSessionChunks + 1), strconv.Itoa(minChunkSize), http.StatusBadRequest, 0},
+		{"分片数等于上限", strconv.Itoa(minChunkSize * maxSessionChunks), strconv.Itoa(minChunkSize), http.StatusOK, maxSessionChunks},
+		{"超大文件不溢出", "9223372036854775807", strconv.Itoa(minChunkSize), http.StatusBadRequest, 0},
+		{"大小无效", "0", "", http.StatusBadRequest, 0},
+	}
+	for i, tt := range tests {
+		form := url.Values{"filename": {"f" + strconv.Itoa(i) + ".bin"}, "size": {tt.size}}
+		if tt.chunkSize != "" {
+			form.Set("chunk_size", tt.chunkSize)
+		}
+		w := postForm(handleUploadSession, "/upload_session", form)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+			continue
+		}
+		if w.Code == http.StatusOK {
+			var st SessionStatus
+			json.Unmarshal(w.Body.Bytes(), &st)
+			if st.TotalChunks != tt.chunks {
+				t.Errorf("%s: total_chunks = %d, want %d", tt.name, st.TotalChunks, tt.chunks)
+			}
+		}
+	}
+}
+
+func TestUploadSessionMerge(t *testing.T) {
+	tg := setupTest(t)
+	create := func(name string) SessionStatus {
+		w := postForm(handleUploadSession, "/upload_session", url.Values{"filename": {name}, "size": {"5"}})
+		var st SessionStatus
+		json.Unmarshal(w.Body.Bytes(), &st)
+		return st
+	}
+
+	tests := []struct {
+		name     string
+		upload   bool // 合并前上传分片
+		failSend bool // Telegram 发送清单失败
+		want     int
+	}{
+		{"分片不完整", false, false, http.StatusConflict},
+		{"发送清单失败", true, true, http.StatusBadGateway},
+		{"合并成功", true, false, http.StatusOK},
+	}
+	for i, tt := range tests {
+		st := create("m" + strconv.Itoa(i) + ".bin")
+		if tt.upload {
+			if w := postChunk(t, st.SessionID, 0, []byte("hello")); w.Code != http.StatusOK {
+				t.Fatalf("%s: upload chunk: %d %s", tt.name, w.Code, w.Body)
+			}
+		}
+		tg.setFailSend(tt.failSend)
+		w := postForm(handleMergeChunks, "/merge_chunks", url.Values{"session_id": {st.SessionID}})
+		tg.setFailSend(false)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+		if w.Code == http.StatusOK {
+			if w := postChunk(t, st.SessionID, 0, []byte("hello")); w.Code != http.StatusConflict {
+				t.Errorf("%s: upload chunk after merge: status %d, want %d", tt.name, w.Code, http.StatusConflict)
+			}
+		}
+	}
+	if w := postForm(handleMergeChunks, "/merge_chunks", url.Values{"session_id": {"missing"}}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	errShareNotFound  = errors.New("分享链接不存在或已撤销")
+	errShareExpired   = errors.New("分享链接已过期")
+	errShareExhausted = errors.New("分享链接下载次数已用完")
+	errSharePassword  = errors.New("分享密码错误")
+)
+
+// sharePasswordIterations 分享密码 PBKDF2-SHA256 迭代次数
+const sharePasswordIterations = 100000
+
+// ShareLink 文件分享链接，通过 /s/{token} 访问，可设置有效期、下载次数上限和访问密码
+type ShareLink struct {
+	Token        string    `json:"token"`
+	FileRecordID string    `json:"file_record_id"`
+	Filename     string    `json:"filename"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`     // 为空表示永不过期
+	MaxDownloads int       `json:"max_downloads,omitempty"` // 0 表示不限次数
+	Downloads    int       `json:"downloads"`
+	// ServedBytes 已输出的字节数，按字节数折算的下载次数超过 Downloads 时以折算结果为准
+	ServedBytes int64     `json:"served_bytes,omitempty"`
+	Password    string    `json:"password,omitempty"` // PBKDF2 哈希，接口返回时清空
+	Protected   bool      `json:"protected"`
+	Revoked     bool      `json:"revoked,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Creator     string    `json:"creator"`
+}
+
+// check 检查分享链接当前是否可用
+func (s *ShareLink) check(now time.Time) error {
+	switch {
+	case s.Revoked:
+		return errShareNotFound
+	case !s.ExpiresAt.IsZero() && now.After(s.ExpiresAt):
+		return errShareExpired
+	case s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads:
+		return errShareExhausted
+	}
+	return nil
+}
+
+// public 返回不含密码哈希的副本，用于接口输出
+func (s *ShareLink) public() *ShareLink {
+	c := *s
+	c.Password = ""
+	return &c
+}
+
+// hashSharePassword 生成 "pbkdf2-sha256$迭代次数$salt$hash" 格式的密码哈希
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", sharePasswordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkSharePassword 校验分享密码
+func checkSharePassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err1 := enc.DecodeString(parts[2])
+	want, err2 := enc.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// newShareToken 生成 128 位随机分享 token
+func newShareToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseShareDuration 解析有效期，除 time.ParseDuration 的格式外还支持按天计算，如 7d
+func parseShareDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("有效期格式错误: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("有效期格式错误: %s", s)
+	}
+	return d, nil
+}
+
+// ShareOptions 创建分享链接的参数
+type ShareOptions struct {
+	ExpiresIn    time.Duration
+	MaxDownloads int
+	Password     string
+}
+
+// createShare 为目录中的文件创建分享链接
+func createShare(rec *FileRecord, opts ShareOptions, creator string) (*ShareLink, error) {
+	if opts.MaxDownloads < 0 {
+		return nil, errors.New("下载次数不能为负数")
+	}
+	s := &ShareLink{
+		Token:        newShareToken(),
+		FileRecordID: rec.ID,
+		Filename:     rec.Filename,
+		MaxDownloads: opts.MaxDownloads,
+		CreatedAt:    time.Now(),
+		Creator:      creator,
+	}
+	if opts.ExpiresIn > 0 {
+		s.ExpiresAt = s.CreatedAt.Add(opts.ExpiresIn)
+	}
+	if opts.Password != "" {
+		hash, err := hashSharePassword(opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		s.Password, s.Protected = hash, true
+	}
+	if err := catalog.PutShare(s); err != nil {
+		return nil, err
+	}
+	log.Printf("创建分享链接 %s: %s", s.Token, rec.Filename)
+	return s, nil
+}
+
+// PutShare 保存分享链接
+func (c *Catalog) PutShare(s *ShareLink) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketShares).Put([]byte(s.Token), data)
+	})
+}
+
+// GetShare 按 token 查询分享链接
+func (c *Catalog) GetShare(token string) (*ShareLink, error) {
+	var s *ShareLink
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketShares).Get([]byte(token))
+		if data == nil {
+			return errShareNotFound
+		}
+		s = &ShareLink{}
+		return json.Unmarshal(data, s)
+	})
+	return s, err
+}
+
+// ListShares 列出分享链接，recordID 非空时只列出该文件的链接，按创建时间倒序
+func (c *Catalog) ListShares(recordID string) ([]*ShareLink, error) {
+	list := []*ShareLink{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketShares).ForEach(func(_, v []byte) error {
+			s := &ShareLink{}
+			if err := json.Unmarshal(v, s); err != nil {
+				return err
+			}
+			if recordID == "" || s.FileRecordID == recordID {
+				list = append(list, s.public())
+			}
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list, err
+}
+
+// RevokeShare 撤销分享链接，记录保留以便查看下载次数
+func (c *Catalog) RevokeShare(token string) (*ShareLink, error) {
+	return c.updateShare(token, func(s *ShareLink) error {
+		s.Revoked = true
+		return nil
+	})
+}
+
+// ClaimShareDownload 在同一事务中检查分享链接是否可用并将下载次数加一，避免并发下载超出次数上限
+func (c *Catalog) ClaimShareDownload(token string) (*ShareLink, error) {
+	return c.updateShare(token, func(s *ShareLink) error {
+		if err := s.check(time.Now()); err != nil {
+			return err
+		}
+		s.Downloads++
+		return nil
+	})
+}
+
+// AddShareBytes 记录分享链接输出的字节数，按文件大小折算下载次数。
+// 只带 Range（如 bytes=1-）的请求不在下载前计数，重复请求也会按字节数累计到下载次数上
+func (c *Catalog) AddShareBytes(token string, n, size int64) (*ShareLink, error) {
+	return c.updateShare(token, func(s *ShareLink) error {
+		s.ServedBytes += n
+		if size > 0 {
+			s.Downloads = max(s.Downloads, int((s.ServedBytes+size-1)/size))
+		}
+		return nil
+	})
+}
+
+func (c *Catalog) updateShare(token string, fn func(*ShareLink) error) (*ShareLink, error) {
+	var s *ShareLink
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketShares)
+		data := b.Get([]byte(token))
+		if data == nil {
+			return errShareNotFound
+		}
+		s = &ShareLink{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return err
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(token), data)
+	})
+	return s, err
+}
+
+// deleteSharesTx 删除文件的所有分享链接
+func deleteSharesTx(tx *bolt.Tx, recordID string) error {
+	b := tx.Bucket(bucketShares)
+	var tokens [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		s := &ShareLink{}
+		if json.Unmarshal(v, s) == nil && s.FileRecordID == recordID {
+			tokens = append(tokens, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range tokens {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shareURL 分享链接的完整地址
+func shareURL(base, token string) string {
+	return strings.TrimRight(base, "/") + "/s/" + token
+}
+
+func writeShareError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errShareNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errShareExpired), errors.Is(err, errShareExhausted):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, errSharePassword):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		writeCatalogError(w, err)
+	}
+}
+
+// countsAsDownload 断点续传、播放器拖动等不从头开始的 Range 请求不在下载前计数（输出后按字节数折算），
+// 没有 Range 或任一范围包含第一个字节的请求计为一次下载
+func countsAsDownload(r *http.Request, size int64) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	ranges, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil || len(ranges) == 0 {
+		return err == nil
+	}
+	for _, ra := range ranges {
+		if ra.start == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rangePayload 请求的文件内容字节数（不含多段响应的分隔符），Range 无效时为 0
+func rangePayload(r *http.Request, size int64) int64 {
+	ranges, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		return 0
+	}
+	if len(ranges) == 0 {
+		return size
+	}
+	var n int64
+	for _, ra := range ranges {
+		n += ra.length
+	}
+	return n
+}
+
+// countingResponseWriter 统计成功响应（200、206）输出的响应体字节数
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if w.status == http.StatusOK || w.status == http.StatusPartialContent {
+		w.n += int64(n)
+	}
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// handleShareDownload GET /s/{token}；有密码时通过 X-Share-Password 请求头或 POST 表单的 password 字段提供，
+// 不接受查询参数中的密码，避免密码留在浏览器历史和访问日志中
+func handleShareDownload(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	s, err := catalog.GetShare(token)
+	if err == nil {
+		err = s.check(time.Now())
+	}
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	if s.Protected {
+		password := r.Header.Get("X-Share-Password")
+		if password == "" && r.Method == http.MethodPost {
+			password = r.PostFormValue("password")
+		}
+		if password == "" {
+			writeSharePasswordForm(w, s, "")
+			return
+		}
+		ip := clientIP(r)
+		if err := authGuard.check(ip); err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		if !checkSharePassword(s.Password, password) {
+			authGuard.record(ip, errSharePassword)
+			writeSharePasswordForm(w, s, errSharePassword.Error())
+			return
+		}
+	}
+	rec, err := catalog.GetFile(s.FileRecordID)
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	if countsAsDownload(r, rec.Size) {
+		if _, err := catalog.ClaimShareDownload(token); err != nil {
+			writeShareError(w, err)
+			return
+		}
+	}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	serveFile(cw, r, rec.FileID, recordFilename(rec))
+	if n := min(cw.n, rangePayload(r, rec.Size)); n > 0 {
+		if _, err := catalog.AddShareBytes(token, n, rec.Size); err != nil {
+			log.Printf("记录分享链接 %s 下载字节数失败: %v", token, err)
+		}
+	}
+}
+
+// writeSharePasswordForm 返回输入分享密码的页面
+func writeSharePasswordForm(w http.ResponseWriter, s *ShareLink, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>%s</title>
+    <style>
+        body { font-family: Arial, sans-serif; max-width: 480px; margin: 80px auto; padding: 20px; }
+        input { padding: 8px; width: 70%%; }
+        button { padding: 8px 16px; }
+        .error { color: #c0392b; }
+    </style>
+</head>
+<body>
+    <h2>🔒 %s</h2>
+    <p class="error">%s</p>
+    <form method="POST">
+        <input type="password" name="password" placeholder="请输入分享密码" autofocus>
+        <button type="submit">下载</button>
+    </form>
+</body>
+</html>
+`, html.EscapeString(s.Filename), html.EscapeString(s.Filename), html.EscapeString(message))
+}
+
+// handleCreateShare POST /api/files/{id}/shares，参数 expires_in（如 24h、7d）、max_downloads、password
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permShare)
+	if !ok {
+		return
+	}
+	rec, err := getUserFile(u, r.PathValue("id"))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	var opts ShareOptions
+	if v := r.FormValue("expires_in"); v != "" {
+		if opts.ExpiresIn, err = parseShareDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("max_downloads"); v != "" {
+		if opts.MaxDownloads, err = strconv.Atoi(v); err != nil || opts.MaxDownloads < 0 {
+			http.Error(w, "max_downloads 参数无效", http.StatusBadRequest)
+			return
+		}
+	}
+	opts.Password = r.FormValue("password")
+	s, err := createShare(rec, opts, u.actor())
+	if err != nil {
+		http.Error(w, "创建分享链接失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		*ShareLink
+		URL string `json:"url"`
+	}{s.public(), shareURL(getScheme(r)+"://"+r.Host, s.Token)})
+}
+
+// handleListShares GET /api/shares 或 GET /api/files/{id}/shares，非管理员只列出自己文件的分享链接
+func handleListShares(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permShare)
+	if !ok {
+		return
+	}
+	var recordID string
+	if id := r.PathValue("id"); id != "" {
+		rec, err := getUserFile(u, id)
+		if err != nil {
+			writeCatalogError(w, err)
+			return
+		}
+		recordID = rec.ID
+	}
+	list, err := catalog.ListShares(recordID)
+	if err != nil {
+		http.Error(w, "读取分享链接失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !u.isAdmin() && recordID == "" {
+		visible := []*ShareLink{}
+		for _, s := range list {
+			if _, err := getUserFile(u, s.FileRecordID); err == nil {
+				visible = append(visible, s)
+			}
+		}
+		list = visible
+	}
+	writeJSON(w, list)
+}
+
+// handleRevokeShare DELETE /api/shares/{token}
+func handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permShare)
+	if !ok {
+		return
+	}
+	s, err := catalog.GetShare(r.PathValue("token"))
+	if err == nil {
+		if _, err = getUserFile(u, s.FileRecordID); err != nil {
+			err = errShareNotFound
+		}
+	}
+	if err == nil {
+		s, err = catalog.RevokeShare(s.Token)
+	}
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	log.Printf("撤销分享链接 %s: %s", s.Token, s.Filename)
+	writeJSON(w, s.public())
+}
+
+// handleShareCommand 机器人命令：
+// 回复文件消息 /share [expire=7d] [max=10] [password=xxx] 创建分享链接，
+// 回复文件消息 /share list 列出该文件的分享链接，/share revoke <token> 撤销分享链接
+func handleShareCommand(msg *tgbotapi.Message) {
+	reply := func(text string) {
+		if _, err := bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text)); err != nil {
+			log.Println(err)
+		}
+	}
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 2 && args[0] == "revoke" {
+		s, err := catalog.RevokeShare(args[1])
+		if err != nil {
+			reply("撤销失败: " + err.Error())
+			return
+		}
+		reply(fmt.Sprintf("🚫文件 [%s] 的分享链接已撤销", s.Filename))
+		return
+	}
+	if msg.ReplyToMessage == nil {
+		reply("用法：回复文件消息 /share [expire=7d] [max=10] [password=密码]，/share list 查看，/share revoke <token> 撤销")
+		return
+	}
+	fileID, _ := replyFile(msg.ReplyToMessage)
+	rec, err := catalog.GetFile(fileID)
+	if err != nil {
+		reply("文件不在文件目录中，无法分享")
+		return
+	}
+
+	if len(args) == 1 && args[0] == "list" {
+		list, err := catalog.ListShares(rec.ID)
+		if err != nil {
+			reply("读取分享链接失败: " + err.Error())
+			return
+		}
+		if len(list) == 0 {
+			reply(fmt.Sprintf("文件 [%s] 没有分享链接", rec.Filename))
+			return
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "文件 [%s] 的分享链接：", rec.Filename)
+		for _, s := range list {
+			status := "有效"
+			if err := s.check(time.Now()); err != nil {
+				status = err.Error()
+			}
+			fmt.Fprintf(&b, "\n%s  已下载 %d 次  %s", s.Token, s.Downloads, status)
+		}
+		reply(b.String())
+		return
+	}
+
+	if baseURL == "" {
+		reply("未配置 BASE_URL 参数，无法生成分享链接")
+		return
+	}
+	var opts ShareOptions
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "expire":
+			opts.ExpiresIn, err = parseShareDuration(value)
+		case "max":
+			if opts.MaxDownloads, err = strconv.Atoi(value); err == nil && opts.MaxDownloads < 0 {
+				err = errors.New("下载次数不能为负数")
+			}
+		case "password":
+			opts.Password = value
+		default:
+			err = fmt.Errorf("未知参数: %s", arg)
+		}
+		if err != nil {
+			reply(err.Error())
+			return
+		}
+	}
+	s, err := createShare(rec, opts, "telegram")
+	if err != nil {
+		reply("创建分享链接失败: " + err.Error())
+		return
+	}
+	text := fmt.Sprintf("🔗文件 [%s] 分享链接：\n%s", rec.Filename, shareURL(baseURL, s.Token))
+	if !s.ExpiresAt.IsZero() {
+		text += "\n有效期至：" + s.ExpiresAt.Format("2006-01-02 15:04")
+	}
+	if s.MaxDownloads > 0 {
+		text += fmt.Sprintf("\n最多下载：%d 次", s.MaxDownloads)
+	}
+	if s.Protected {
+		text += "\n访问密码：" + opts.Password
+	}
+	reply(text)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountsAsDownload(t *testing.T) {
+	tests := []struct {
+		method string
+		rng    string
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", false},
+		{http.MethodGet, "bytes=0-", true},
+		{http.MethodGet, "bytes=0-99", true},
+		{http.MethodGet, "bytes=100-", false},
+		{http.MethodGet, "bytes=1-,0-0", true},
+		{http.MethodGet, "bytes= 5-9 , 0-0", true},
+		{http.MethodGet, "bytes=-1000", true}, // 后缀范围超过文件大小，包含第一个字节
+		{http.MethodGet, "bytes=-10", false},
+		{http.MethodGet, "bytes=5000-", false}, // 超出文件大小，返回 416
+		{http.MethodGet, "items=0-1", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/s/x", nil)
+		if tt.rng != "" {
+			r.Header.Set("Range", tt.rng)
+		}
+		if got := countsAsDownload(r, 1000); got != tt.want {
+			t.Errorf("%s Range %q: countsAsDownload = %v, want %v", tt.method, tt.rng, got, tt.want)
+		}
+	}
+}
+
+func TestShareLinkCheck(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		s    ShareLink
+		want error
+	}{
+		{"有效", ShareLink{}, nil},
+		{"已撤销", ShareLink{Revoked: true}, errShareNotFound},
+		{"已过期", ShareLink{ExpiresAt: now.Add(-time.Second)}, errShareExpired},
+		{"未过期", ShareLink{ExpiresAt: now.Add(time.Hour)}, nil},
+		{"次数用完", ShareLink{MaxDownloads: 2, Downloads: 2}, errShareExhausted},
+		{"次数未用完", ShareLink{MaxDownloads: 2, Downloads: 1}, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.s.check(now); err != tt.want {
+			t.Errorf("%s: check() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	hash, err := hashSharePassword("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hash, password string
+		want           bool
+	}{
+		{hash, "1234", true},
+		{hash, "12345", false},
+		{hash, "", false},
+		{"pbkdf2-sha256$0$AAAA$AAAA", "1234", false},
+		{"bcrypt$10$x$y", "1234", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := checkSharePassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("checkSharePassword(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestParseShareDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"2h", 2 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"xd", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseShareDuration(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseShareDuration(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// newTestShare 在目录中放入一个文件并为其创建分享链接
+func newTestShare(t *testing.T, tg *fakeTelegram, content string, opts ShareOptions) *ShareLink {
+	t.Helper()
+	fileID, messageID := tg.upload([]byte(content))
+	rec := &FileRecord{FileID: fileID, MessageID: messageID, Filename: fileID + ".txt", Size: int64(len(content)), Path: "/"}
+	if err := catalog.PutFile(rec); err != nil {
+		t.Fatal(err)
+	}
+	s, err := createShare(rec, opts, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestShareDownloadPassword(t *testing.T) {
+	tg := setupTest(t)
+	s := newTestShare(t, tg, "hello", ShareOptions{Password: "1234"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /s/{token}", handleShareDownload)
+	mux.HandleFunc("POST /s/{token}", handleShareDownload)
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+		want int
+	}{
+		{"没有密码", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/s/"+s.Token, nil)
+		}, http.StatusUnauthorized},
+		{"查询参数中的密码不接受", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/s/"+s.Token+"?password=1234", nil)
+		}, http.StatusUnauthorized},
+		{"请求头", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/s/"+s.Token, nil)
+			r.Header.Set("X-Share-Password", "1234")
+			return r
+		}, http.StatusOK},
+		{"POST 表单", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/s/"+s.Token, strings.NewReader(url.Values{"password": {"1234"}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return r
+		}, http.StatusOK},
+		{"密码错误", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/s/"+s.Token, nil)
+			r.Header.Set("X-Share-Password", "0000")
+			return r
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := serve(mux, tt.req())
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	tg := setupTest(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /s/{token}", handleShareDownload)
+
+	tests := []struct {
+		name   string
+		ranges []string // 依次发出的请求的 Range，"" 表示完整下载
+		want   []int
+	}{
+		{"完整下载", []string{"", "", ""}, []int{200, 200, 410}},
+		{"分段下载只计一次", []string{"bytes=0-4", "bytes=5-", "", ""}, []int{206, 206, 200, 410}},
+		{"多个范围包含第一个字节", []string{"bytes=1-,0-0", "bytes=1-,0-0", "bytes=1-,0-0"}, []int{206, 206, 410}},
+		{"跳过第一个字节按字节数计数", []string{"bytes=1-", "bytes=1-", "bytes=1-"}, []int{206, 206, 410}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestShare(t, tg, "0123456789", ShareOptions{MaxDownloads: 2})
+			for i, rng := range tt.ranges {
+				r := httptest.NewRequest(http.MethodGet, "/s/"+s.Token, nil)
+				if rng != "" {
+					r.Header.Set("Range", rng)
+				}
+				if w := serve(mux, r); w.Code != tt.want[i] {
+					t.Fatalf("request %d (Range %q): status %d, want %d: %s", i, rng, w.Code, tt.want[i], w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateShareCreator(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		name string
+		u    *User
+		want string
+	}{
+		{"账号", &User{Username: "alice", Role: roleUploader}, "alice"},
+		{"访问密码", sharedPwdUser, "ACCESS_PWD"},
+		{"Telegram 登录", &User{Role: roleAdmin, login: &LoginSession{TelegramID: 7}}, "telegram:7"},
+	}
+	for _, tt := range tests {
+		if got := tt.u.actor(); got != tt.want {
+			t.Errorf("%s: actor() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var (
+	errSignatureRequired = errors.New("需要签名的下载链接")
+	errSignatureInvalid  = errors.New("下载链接签名无效")
+	errSignatureExpired  = errors.New("下载链接已过期")
+)
+
+var (
+	signingSecret     []byte
+	requireSignedURLs bool             // 所有 /d 请求都必须带有效签名
+	signedURLTTL      = 24 * time.Hour // 签名链接默认有效期
+)
+
+// loadSigningSecret 使用 SIGNING_SECRET 作为签名密钥；未配置时使用 path 中保存的随机密钥，首次启动时生成
+func loadSigningSecret(secret, path string) error {
+	if secret != "" {
+		signingSecret = []byte(secret)
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if signingSecret, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil || len(signingSecret) < 32 {
+			return fmt.Errorf("签名密钥文件 %s 格式错误", path)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	signingSecret = make([]byte, 32)
+	if _, err := rand.Read(signingSecret); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hex.EncodeToString(signingSecret)), 0600)
+}
+
+// urlSignature 对 file_id、filename 及过期时间计算 HMAC-SHA256
+func urlSignature(fileID, filename string, exp int64) string {
+	mac := hmac.New(sha256.New, signingSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", fileID, filename, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signQuery 为 /d 的查询参数设置 exp、sig
+func signQuery(query url.Values, exp int64) {
+	query.Set("exp", strconv.FormatInt(exp, 10))
+	query.Set("sig", urlSignature(query.Get("file_id"), query.Get("filename"), exp))
+}
+
+// verifySignature 校验 /d 请求的签名：带 sig 参数时必须有效且未过期，未带时仅在 REQUIRE_SIGNED_URLS 开启时拒绝
+func verifySignature(query url.Values, fileID, filename string) error {
+	sig := query.Get("sig")
+	if sig == "" {
+		if requireSignedURLs {
+			return errSignatureRequired
+		}
+		return nil
+	}
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(urlSignature(fileID, filename, exp))) {
+		return errSignatureInvalid
+	}
+	if time.Now().Unix() > exp {
+		return errSignatureExpired
+	}
+	return nil
+}
+
+func writeSignatureError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	if errors.Is(err, errSignatureExpired) {
+		status = http.StatusGone
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// signedDownloadLink 生成有效期为 ttl 的签名下载链接，分块文件 filename 为空
+func signedDownloadLink(base, fileID, filename string, ttl time.Duration) (string, time.Time) {
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	query := url.Values{"file_id": {fileID}}
+	if filename != "" {
+		query.Set("filename", filename)
+	}
+	signQuery(query, expiresAt.Unix())
+	return strings.TrimRight(base, "/") + "/d?" + query.Encode(), expiresAt
+}
+
+// signedFileLink 生成有效期为 ttl 的 /f/{public_id} 签名链接，没有公开 ID 时退回 /d 签名链接
+func signedFileLink(base string, rec *FileRecord, ttl time.Duration) (string, time.Time) {
+	if rec.PublicID == "" {
+		return signedDownloadLink(base, rec.FileID, recordFilename(rec), ttl)
+	}
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	query := url.Values{}
+	query.Set("exp", strconv.FormatInt(expiresAt.Unix(), 10))
+	query.Set("sig", urlSignature(rec.PublicID, "", expiresAt.Unix()))
+	return strings.TrimRight(base, "/") + "/f/" + rec.PublicID + "?" + query.Encode(), expiresAt
+}
+
+// downloadLink 生成 /d 下载链接；开启 REQUIRE_SIGNED_URLS 时生成默认有效期的签名链接
+func downloadLink(base, fileID, filename string) string {
+	if requireSignedURLs {
+		link, _ := signedDownloadLink(base, fileID, filename, signedURLTTL)
+		return link
+	}
+	query := url.Values{"file_id": {fileID}}
+	if filename != "" {
+		query.Set("filename", filename)
+	}
+	return strings.TrimRight(base, "/") + "/d?" + query.Encode()
+}
+
+// handleSign POST /api/sign，参数 id（文件记录 ID、公开 ID 或 file_id）或 file_id + filename，expires_in（如 2h、7d）
+func handleSign(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permShare)
+	if !ok {
+		return
+	}
+	ttl := signedURLTTL
+	if v := r.FormValue("expires_in"); v != "" {
+		var err error
+		if ttl, err = parseShareDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	base := getScheme(r) + "://" + r.Host
+	var link string
+	var expiresAt time.Time
+	if id := r.FormValue("id"); id != "" {
+		rec, err := catalog.GetFile(id)
+		if errors.Is(err, errFileNotFound) {
+			rec, err = catalog.GetFileByPublicID(id)
+		}
+		if err == nil && !u.owns(rec) {
+			err = errFileNotFound
+		}
+		if err != nil {
+			writeCatalogError(w, err)
+			return
+		}
+		link, expiresAt = signedFileLink(base, rec, ttl)
+	} else if fileID := r.FormValue("file_id"); fileID != "" {
+		// 不在文件目录中的文件，只有管理员可以签名
+		if !u.isAdmin() {
+			http.Error(w, errForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		link, expiresAt = signedDownloadLink(base, fileID, r.FormValue("filename"), ttl)
+	} else {
+		http.Error(w, "缺少 id 或 file_id 参数", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]any{"url": link, "expires_at": expiresAt})
+}
+
+// handleSignCommand 机器人命令：回复文件消息 /sign [有效期，如 2h、7d] 获取签名下载链接
+func handleSignCommand(msg *tgbotapi.Message) {
+	reply := func(text string) {
+		if _, err := bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text)); err != nil {
+			log.Println(err)
+		}
+	}
+	if baseURL == "" {
+		reply("未配置 BASE_URL 参数，无法生成签名链接")
+		return
+	}
+	ttl := signedURLTTL
+	if arg := strings.TrimSpace(msg.CommandArguments()); arg != "" {
+		var err error
+		if ttl, err = parseShareDuration(arg); err != nil {
+			reply(err.Error())
+			return
+		}
+	}
+	fileID, fileName := replyFile(msg.ReplyToMessage)
+	if fileID == "" {
+		reply("无法获取文件ID")
+		return
+	}
+	var link string
+	var expiresAt time.Time
+	if rec, err := catalog.GetFile(fileID); err == nil {
+		link, expiresAt = signedFileLink(baseURL, rec, ttl)
+	} else {
+		if isManifestName(fileName) {
+			fileName = ""
+		}
+		link, expiresAt = signedDownloadLink(baseURL, fileID, fileName, ttl)
+	}
+	reply(fmt.Sprintf("🔏签名下载链接（有效期至 %s）：\n%s", expiresAt.Format("2006-01-02 15:04"), link))
+}
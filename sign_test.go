@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	signingSecret = []byte("0123456789abcdef0123456789abcdef")
+	signed := func(fileID, filename string, exp time.Time) url.Values {
+		query := url.Values{"file_id": {fileID}, "filename": {filename}}
+		signQuery(query, exp.Unix())
+		return query
+	}
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Second)
+	tests := []struct {
+		name     string
+		query    url.Values
+		fileID   string
+		filename string
+		require  bool
+		want     error
+	}{
+		{"有效签名", signed("f1", "a.txt", future), "f1", "a.txt", false, nil},
+		{"开启强制签名时有效", signed("f1", "a.txt", future), "f1", "a.txt", true, nil},
+		{"file_id 不匹配", signed("f1", "a.txt", future), "f2", "a.txt", false, errSignatureInvalid},
+		{"filename 不匹配", signed("f1", "a.txt", future), "f1", "b.txt", false, errSignatureInvalid},
+		{"已过期", signed("f1", "a.txt", past), "f1", "a.txt", false, errSignatureExpired},
+		{"篡改过期时间", func() url.Values {
+			q := signed("f1", "a.txt", past)
+			q.Set("exp", strconv.FormatInt(future.Unix(), 10))
+			return q
+		}(), "f1", "a.txt", false, errSignatureInvalid},
+		{"缺少过期时间", func() url.Values {
+			q := signed("f1", "a.txt", future)
+			q.Del("exp")
+			return q
+		}(), "f1", "a.txt", false, errSignatureInvalid},
+		{"没有签名", url.Values{"file_id": {"f1"}}, "f1", "a.txt", false, nil},
+		{"开启强制签名时没有签名", url.Values{"file_id": {"f1"}}, "f1", "a.txt", true, errSignatureRequired},
+	}
+	for _, tt := range tests {
+		requireSignedURLs = tt.require
+		if err := verifySignature(tt.query, tt.fileID, tt.filename); !errors.Is(err, tt.want) {
+			t.Errorf("%s: verifySignature() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	requireSignedURLs = false
+}
+
+func TestSignedLinks(t *testing.T) {
+	signingSecret = []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name             string
+		link             string
+		fileID, filename string
+	}{
+		{"单文件", first(signedDownloadLink("http://x", "f1", "a b.txt", time.Hour)), "f1", "a b.txt"},
+		{"分块文件", first(signedDownloadLink("http://x/", "m1", "", time.Hour)), "m1", ""},
+		{"公开 ID", first(signedFileLink("http://x", &FileRecord{PublicID: "Ab3", FileID: "f1", Filename: "a.txt"}, time.Hour)), "Ab3", ""},
+		{"没有公开 ID", first(signedFileLink("http://x", &FileRecord{FileID: "f1", Filename: "a.txt"}, time.Hour)), "f1", "a.txt"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verifySignature(u.Query(), tt.fileID, tt.filename); err != nil {
+			t.Errorf("%s: %s: verifySignature() = %v", tt.name, tt.link, err)
+		}
+	}
+}
+
+func first(link string, _ time.Time) string {
+	return link
+}
+
+func TestLoadSigningSecret(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	os.WriteFile(existing, []byte("00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff\n"), 0600)
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, []byte("0011"), 0600)
+	invalid := filepath.Join(dir, "invalid")
+	os.WriteFile(invalid, []byte("not hex"), 0600)
+
+	tests := []struct {
+		name    string
+		secret  string
+		path    string
+		wantLen int
+		wantErr bool
+	}{
+		{"环境变量", "my-secret", filepath.Join(dir, "unused"), 9, false},
+		{"读取已有密钥", "", existing, 32, false},
+		{"首次启动生成", "", filepath.Join(dir, "new"), 32, false},
+		{"密钥过短", "", short, 0, true},
+		{"格式错误", "", invalid, 0, true},
+	}
+	for _, tt := range tests {
+		signingSecret = nil
+		err := loadSigningSecret(tt.secret, tt.path)
+		if (err != nil) != tt.wantErr || !tt.wantErr && len(signingSecret) != tt.wantLen {
+			t.Errorf("%s: loadSigningSecret() = %v, secret %d bytes; want %d bytes, error %v", tt.name, err, len(signingSecret), tt.wantLen, tt.wantErr)
+		}
+	}
+	// 生成的密钥保存后，下次启动读取到相同的密钥
+	signingSecret = nil
+	if err := loadSigningSecret("", filepath.Join(dir, "saved")); err != nil {
+		t.Fatal(err)
+	}
+	generated := signingSecret
+	signingSecret = nil
+	if err := loadSigningSecret("", filepath.Join(dir, "saved")); err != nil || string(signingSecret) != string(generated) {
+		t.Errorf("reload generated secret: %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// sendChunkFile 计算本地分块文件的大小和 SHA-256，并以 blob 文档形式发送到 Telegram
+// （filename 为所属文件名，可压缩时先压缩，开启加密时发送密文）；
+// dedup 为 true 时，相同内容已经发送过则直接复用，不再发送
+func sendChunkFile(chunkPath, caption, filename string, dedup bool) (ChunkInfo, error) {
+	f, err := os.Open(chunkPath)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	f.Close()
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	sha := hex.EncodeToString(hasher.Sum(nil))
+	if dedup {
+		if blob, ok := dedupBlob(sha, size, false); ok {
+			return blob, nil
+		}
+	}
+
+	blob := ChunkInfo{Size: size, SHA256: sha}
+	sendPath := chunkPath
+	if alg := compressionFor(filename, chunkPath); alg != "" {
+		compressedPath := chunkPath + ".z"
+		defer os.Remove(compressedPath)
+		ok, err := compressFile(chunkPath, compressedPath, alg)
+		if err != nil {
+			return ChunkInfo{}, fmt.Errorf("压缩分片失败: %w", err)
+		}
+		if ok {
+			sendPath, blob.Compression = compressedPath, alg
+		}
+	}
+	if encryptionEnabled() {
+		encryptedPath := chunkPath + ".enc"
+		defer os.Remove(encryptedPath)
+		if blob.KeyID, blob.Nonce, err = encryptFile(sendPath, encryptedPath); err != nil {
+			return ChunkInfo{}, fmt.Errorf("加密分片失败: %w", err)
+		}
+		sendPath = encryptedPath
+	}
+	if blob.Compression != "" {
+		stat, err := os.Stat(sendPath)
+		if err != nil {
+			return ChunkInfo{}, err
+		}
+		blob.StoredSize = stat.Size()
+	}
+
+	var file tgbotapi.RequestFileData = tgbotapi.FilePath(sendPath)
+	if blob.KeyID != "" {
+		// 临时文件名可能包含原始文件名（如直接上传），密文统一以 blob 为文件名发送
+		f, err := os.Open(sendPath)
+		if err != nil {
+			return ChunkInfo{}, err
+		}
+		defer f.Close()
+		file = tgbotapi.FileReader{Name: "blob", Reader: f}
+	}
+	doc := tgbotapi.NewDocument(chatID, file)
+	doc.Caption = caption
+	msg, err := bot.Send(doc)
+	if err != nil {
+		return ChunkInfo{}, fmt.Errorf("上传分片到 Telegram 失败: %w", err)
+	}
+	if msg.Document == nil {
+		return ChunkInfo{}, errors.New("上传分片到 Telegram 失败: 未返回文件信息")
+	}
+	blob.FileID, blob.MessageID = msg.Document.FileID, msg.MessageID
+	rememberBlob(blob)
+	return blob, nil
+}
+
+// storedSize 分块在 Telegram 上的实际大小
+func storedSize(c ChunkInfo) int64 {
+	switch {
+	case c.StoredSize > 0:
+		return c.StoredSize
+	case c.KeyID != "":
+		return c.Size + encryptionOverhead
+	}
+	return c.Size
+}
+
+// dedupBlob 在去重索引中查找相同内容，并确认其在 Telegram 上仍可访问。
+// 只复用以当前密钥加密（未开启加密时为明文）的内容，轮换密钥后旧密钥加密的内容不再被新文件引用；
+// raw 为 true 时调用方直接记录 file_id、不经过清单解码，压缩过的内容也不能复用
+func dedupBlob(sha string, size int64, raw bool) (ChunkInfo, bool) {
+	blob, ok := catalog.LookupBlob(sha)
+	if !ok || blob.Size != size || blob.KeyID != encryptionKeyID || raw && blob.Compression != "" {
+		return ChunkInfo{}, false
+	}
+	if _, err := getTelegramFile(blob.FileID); err != nil {
+		log.Printf("去重索引中的 %s 已失效: %v", blob.FileID, err)
+		catalog.ForgetBlob(blob.FileID)
+		return ChunkInfo{}, false
+	}
+	log.Printf("内容已存在，复用 %s（%d 字节）", blob.FileID, size)
+	return blob, true
+}
+
+// rememberBlob 将新发送的内容写入去重索引，失败只记录日志
+func rememberBlob(blob ChunkInfo) {
+	if err := catalog.PutBlob(blob); err != nil {
+		log.Printf("写入去重索引失败 [%s]: %v", blob.FileID, err)
+	}
+}
+
+// dedupRequested 请求参数 dedup=0 / false 时关闭去重，强制重新发送
+func dedupRequested(r *http.Request) bool {
+	v := r.FormValue("dedup")
+	return v != "0" && v != "false"
+}
+
+// chunkCaption 生成分块消息的说明文字，index 从 0 开始；开启加密时不包含文件名
+func chunkCaption(index, total int, filename string) string {
+	if encryptionEnabled() {
+		return fmt.Sprintf("blob [%d/%d]", index, total)
+	}
+	return fmt.Sprintf("blob [%d/%d] - %s", index, total, filename)
+}
+
+// deleteMessage 通过 Bot API 删除存储聊天中的消息，消息已不存在视为成功
+func deleteMessage(messageID int) error {
+	if messageID == 0 {
+		return errors.New("未记录消息 ID，无法删除")
+	}
+	_, err := bot.Request(tgbotapi.NewDeleteMessage(chatID, messageID))
+	if err != nil && strings.Contains(err.Error(), "message to delete not found") {
+		return nil
+	}
+	return err
+}
+
+// deleteBlob 删除分块消息，并移除指向它的去重索引
+func deleteBlob(c ChunkInfo) error {
+	if err := deleteMessage(c.MessageID); err != nil {
+		return err
+	}
+	if err := catalog.ForgetBlob(c.FileID); err != nil {
+		log.Printf("移除去重索引失败 [%s]: %v", c.FileID, err)
+	}
+	return nil
+}
+
+// writeJSONFile 原子写入 JSON 文件（先写临时文件再重命名），用于持久化会话状态
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stateDir 在目录中以 {id}.json 保存会话状态，并为每个会话提供互斥锁
+type stateDir struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newStateDir(dir string) (*stateDir, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &stateDir{dir: dir, locks: make(map[string]*sync.Mutex)}, nil
+}
+
+// lock 获取单个会话的锁，同一会话的请求串行处理
+func (d *stateDir) lock(id string) func() {
+	d.mu.Lock()
+	l, ok := d.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		d.locks[id] = l
+	}
+	d.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (d *stateDir) statePath(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+func (d *stateDir) load(id string, v any) error {
+	if !validSessionID(id) {
+		return os.ErrNotExist
+	}
+	return readJSONFile(d.statePath(id), v)
+}
+
+func (d *stateDir) save(id string, v any) error {
+	return writeJSONFile(d.statePath(id), v)
+}
+
+// remove 删除会话状态及以 {id}. 开头的所有附属文件
+func (d *stateDir) remove(id string) error {
+	matches, _ := filepath.Glob(filepath.Join(d.dir, id+".*"))
+	var err error
+	for _, m := range matches {
+		if e := os.Remove(m); e != nil && !errors.Is(e, os.ErrNotExist) {
+			err = e
+		}
+	}
+	d.mu.Lock()
+	delete(d.locks, id)
+	d.mu.Unlock()
+	if len(matches) == 0 {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// ids 列出目录中的所有会话 ID
+func (d *stateDir) ids() []string {
+	matches, _ := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	ids := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if id := strings.TrimSuffix(filepath.Base(m), ".json"); validSessionID(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// validSessionID 会话 ID 由 newID 生成，只包含小写十六进制字符
+func validSessionID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
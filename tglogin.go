@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Telegram 登录：网页通过 Telegram Login Widget 登录，按 Bot Token 校验登录数据的签名。
+// 允许使用的 Telegram 用户为 CHAT_ID 及 TELEGRAM_USERS 中的用户，同时也是可以使用机器人的用户：
+// 只写用户 ID 的条目与 CHAT_ID 一样为管理员，"用户 ID=用户名" 的条目登录为对应的 tg-disk 账号
+const telegramAuthMaxAge = 24 * time.Hour // 登录数据的有效期
+
+var (
+	telegramLogin    bool             // 是否启用 Telegram 登录（TELEGRAM_LOGIN）
+	telegramLoginKey []byte           // SHA-256(Bot Token)，校验登录数据的 HMAC 密钥
+	telegramUsers    map[int64]string // TELEGRAM_USERS：Telegram 用户 ID -> 用户名，为空表示管理员
+
+	errTelegramAuth    = errors.New("Telegram 登录数据校验失败")
+	errTelegramExpired = errors.New("Telegram 登录已过期，请重新登录")
+	errTelegramUser    = errors.New("该 Telegram 用户无权访问")
+)
+
+// parseTelegramUsers 解析逗号分隔的 "用户 ID" 或 "用户 ID=用户名"
+func parseTelegramUsers(s string) (map[int64]string, error) {
+	users := make(map[int64]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idStr, name, _ := strings.Cut(item, "=")
+		id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 Telegram 用户 ID: %s", idStr)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !usernamePattern.MatchString(name) {
+			return nil, fmt.Errorf("无效的用户名: %s", name)
+		}
+		users[id] = name
+	}
+	return users, nil
+}
+
+// telegramUser Telegram 用户对应的身份：CHAT_ID 及未指定用户名的条目为管理员，其余为对应的账号
+func telegramUser(id int64) (*User, error) {
+	name, ok := telegramUsers[id]
+	if id == chatID {
+		name, ok = "", true
+	}
+	if !ok {
+		return nil, errTelegramUser
+	}
+	if name == "" {
+		c := *sharedPwdUser
+		return &c, nil
+	}
+	u, err := catalog.GetUser(name)
+	if err != nil {
+		return nil, errTelegramUser
+	}
+	if u.Disabled {
+		return nil, errUserDisabled
+	}
+	return u, nil
+}
+
+// canUseBot 机器人命令可以操作所有文件，只允许对应管理员身份的 Telegram 用户使用
+func canUseBot(id int64) bool {
+	u, err := telegramUser(id)
+	return err == nil && u.isAdmin()
+}
+
+// checkTelegramAuth 校验 Login Widget 返回的登录数据，返回 Telegram 用户 ID。
+// 签名为 HMAC-SHA256(SHA-256(Bot Token), 除 hash 外按键排序的 "key=value" 以换行连接)
+func checkTelegramAuth(values url.Values) (int64, error) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		if k != "hash" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = k + "=" + values.Get(k)
+	}
+	mac := hmac.New(sha256.New, telegramLoginKey)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	if !hmac.Equal([]byte(strings.ToLower(values.Get("hash"))), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return 0, errTelegramAuth
+	}
+	authDate, err := strconv.ParseInt(values.Get("auth_date"), 10, 64)
+	if err != nil {
+		return 0, errTelegramAuth
+	}
+	if time.Since(time.Unix(authDate, 0)) > telegramAuthMaxAge {
+		return 0, errTelegramExpired
+	}
+	id, err := strconv.ParseInt(values.Get("id"), 10, 64)
+	if err != nil {
+		return 0, errTelegramAuth
+	}
+	return id, nil
+}
+
+// handleTelegramLogin GET /telegram/login，Login Widget 的 data-auth-url，登录成功后跳转到上传页面
+func handleTelegramLogin(w http.ResponseWriter, r *http.Request) {
+	if !telegramLogin {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := checkTelegramAuth(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	u, err := telegramUser(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	s := newLoginSession(r, u)
+	s.TelegramID = id
+	if err := saveLoginSession(w, r, s); err != nil {
+		http.Error(w, "创建登录会话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Telegram 用户 %d (%s) 登录，IP: %s", id, r.URL.Query().Get("username"), clientIP(r))
+	http.Redirect(w, r, "/upload.html", http.StatusFound)
+}
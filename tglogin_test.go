@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTelegramAuth 按 Login Widget 的规则为登录数据签名
+func signTelegramAuth(values url.Values) url.Values {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = k + "=" + values.Get(k)
+	}
+	mac := hmac.New(sha256.New, telegramLoginKey)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	signed := url.Values{"hash": {hex.EncodeToString(mac.Sum(nil))}}
+	maps.Copy(signed, values)
+	return signed
+}
+
+// withTelegramLogin 启用 Telegram 登录，Bot Token 为 "TOKEN"
+func withTelegramLogin(t *testing.T, users map[int64]string) {
+	t.Helper()
+	oldLogin, oldKey, oldUsers := telegramLogin, telegramLoginKey, telegramUsers
+	t.Cleanup(func() { telegramLogin, telegramLoginKey, telegramUsers = oldLogin, oldKey, oldUsers })
+	key := sha256.Sum256([]byte("TOKEN"))
+	telegramLogin, telegramLoginKey, telegramUsers = true, key[:], users
+}
+
+func TestCheckTelegramAuth(t *testing.T) {
+	withTelegramLogin(t, nil)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	valid := url.Values{"id": {"7"}, "first_name": {"Alice"}, "username": {"alice"}, "auth_date": {now}}
+	tests := []struct {
+		name   string
+		values url.Values
+		want   int64
+		err    error
+	}{
+		{"有效", signTelegramAuth(valid), 7, nil},
+		{"大写的哈希", func() url.Values {
+			v := signTelegramAuth(valid)
+			v.Set("hash", strings.ToUpper(v.Get("hash")))
+			return v
+		}(), 7, nil},
+		{"篡改用户 ID", func() url.Values {
+			v := signTelegramAuth(valid)
+			v.Set("id", "8")
+			return v
+		}(), 0, errTelegramAuth},
+		{"添加字段", func() url.Values {
+			v := signTelegramAuth(valid)
+			v.Set("photo_url", "https://example.com/a.jpg")
+			return v
+		}(), 0, errTelegramAuth},
+		{"没有签名", valid, 0, errTelegramAuth},
+		{"其他 Bot 的签名", func() url.Values {
+			key := telegramLoginKey
+			other := sha256.Sum256([]byte("OTHER"))
+			telegramLoginKey = other[:]
+			defer func() { telegramLoginKey = key }()
+			return signTelegramAuth(valid)
+		}(), 0, errTelegramAuth},
+		{"已过期", signTelegramAuth(url.Values{"id": {"7"}, "auth_date": {strconv.FormatInt(time.Now().Add(-telegramAuthMaxAge-time.Minute).Unix(), 10)}}), 0, errTelegramExpired},
+		{"缺少 auth_date", signTelegramAuth(url.Values{"id": {"7"}}), 0, errTelegramAuth},
+		{"用户 ID 无效", signTelegramAuth(url.Values{"id": {"x"}, "auth_date": {now}}), 0, errTelegramAuth},
+	}
+	for _, tt := range tests {
+		id, err := checkTelegramAuth(tt.values)
+		if id != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%s: checkTelegramAuth() = %d, %v; want %d, %v", tt.name, id, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseTelegramUsers(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[int64]string
+		wantErr bool
+	}{
+		{"", map[int64]string{}, false},
+		{"123, 456=Alice", map[int64]string{123: "", 456: "alice"}, false},
+		{"123,,", map[int64]string{123: ""}, false},
+		{"abc", nil, true},
+		{"123=../admin", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTelegramUsers(tt.in)
+		if (err != nil) != tt.wantErr || (err == nil && !maps.Equal(got, tt.want)) {
+			t.Errorf("parseTelegramUsers(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTelegramLogin(t *testing.T) {
+	setupTest(t)
+	withTelegramLogin(t, map[int64]string{7: "", 8: "alice", 9: "nobody"})
+	hash, err := hashUserPassword("alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.CreateUser(&User{Username: "alice", PasswordHash: hash, Role: roleUploader}); err != nil {
+		t.Fatal(err)
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	tests := []struct {
+		name   string
+		id     int64
+		status int
+		user   string
+		role   Role
+	}{
+		{"CHAT_ID", chatID, http.StatusFound, "", roleAdmin},
+		{"管理员", 7, http.StatusFound, "", roleAdmin},
+		{"绑定账号", 8, http.StatusFound, "alice", roleUploader},
+		{"账号不存在", 9, http.StatusForbidden, "", ""},
+		{"不在允许列表中", 10, http.StatusForbidden, "", ""},
+	}
+	for _, tt := range tests {
+		values := signTelegramAuth(url.Values{"id": {strconv.FormatInt(tt.id, 10)}, "auth_date": {now}})
+		w := serve(http.HandlerFunc(handleTelegramLogin), httptest.NewRequest(http.MethodGet, "/telegram/login?"+values.Encode(), nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if w.Code != http.StatusFound {
+			continue
+		}
+		r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		u, err := authenticate(r)
+		if err != nil {
+			t.Errorf("%s: authenticate() error = %v", tt.name, err)
+			continue
+		}
+		if u.Username != tt.user || u.Role != tt.role {
+			t.Errorf("%s: user = %q (%s), want %q (%s)", tt.name, u.Username, u.Role, tt.user, tt.role)
+		}
+		if want := "telegram:" + strconv.FormatInt(tt.id, 10); tt.user == "" && u.actor() != want {
+			t.Errorf("%s: actor() = %q, want %q", tt.name, u.actor(), want)
+		}
+	}
+}
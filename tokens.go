@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// API 令牌：供脚本调用接口，通过 Authorization: Bearer 传递。令牌只在创建时返回一次，
+// 服务端只保存其 SHA-256；令牌继承创建者的角色和目录，并只能执行 scopes 中的操作
+const (
+	scopeRead   = "read"   // 浏览、查询、校验文件
+	scopeUpload = "upload" // 上传、整理文件
+	scopeDelete = "delete" // 删除文件、目录
+	scopeShare  = "share"  // 创建、列出、撤销分享链接，创建签名链接
+
+	tokenPrefix = "tgd_"
+)
+
+var (
+	bucketTokens = []byte("tokens") // 令牌 SHA-256 -> APIToken JSON
+
+	errTokenInvalid  = errors.New("API 令牌无效")
+	errTokenExpired  = errors.New("API 令牌已过期")
+	errTokenScope    = errors.New("API 令牌无权执行该操作")
+	errTokenNotFound = errors.New("API 令牌不存在")
+)
+
+// APIToken 个人 API 令牌
+type APIToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"` // 创建者，使用 ACCESS_PWD 创建时为空
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"` // 为空表示永不过期
+	CreatedAt time.Time `json:"created_at"`
+	// PwdTag 使用 ACCESS_PWD 创建时访问密码的 HMAC，访问密码修改后令牌随之失效，接口返回时清空
+	PwdTag string `json:"pwd_tag,omitempty"`
+	// TelegramID 通过 Telegram 登录后创建时的 Telegram 用户 ID，移出允许列表后令牌随之失效
+	TelegramID int64 `json:"telegram_id,omitempty"`
+}
+
+// public 返回不含 PwdTag 的副本，用于接口输出
+func (t *APIToken) public() *APIToken {
+	c := *t
+	c.PwdTag = ""
+	return &c
+}
+
+func (t *APIToken) allows(scope string) bool {
+	return scope != "" && slices.Contains(t.Scopes, scope)
+}
+
+// scopeRole 使用该权限范围所需的最低角色
+func scopeRole(scope string) Role {
+	switch scope {
+	case scopeRead:
+		return roleViewer
+	case scopeUpload, scopeDelete, scopeShare:
+		return roleUploader
+	}
+	return ""
+}
+
+// parseScopes 解析逗号分隔的权限范围，并检查用户的角色是否允许
+func parseScopes(s string, u *User) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || slices.Contains(scopes, scope) {
+			continue
+		}
+		role := scopeRole(scope)
+		if role == "" {
+			return nil, errors.New("不支持的权限范围: " + scope + "，可选 read、upload、delete、share")
+		}
+		if !u.can(role) {
+			return nil, errors.New("当前角色不能创建 " + scope + " 权限的令牌")
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("缺少 scopes 参数，可选 read、upload、delete、share，逗号分隔")
+	}
+	return scopes, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIToken 生成 256 位随机令牌
+func newAPIToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// bearerToken 读取 Authorization: Bearer 头部中的令牌
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authenticateToken 校验 API 令牌，返回带有该令牌的创建者身份
+func authenticateToken(token string) (*User, error) {
+	t, err := catalog.GetToken(hashToken(token))
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	if !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt) {
+		return nil, errTokenExpired
+	}
+	var u *User
+	switch {
+	case t.TelegramID != 0:
+		// 关闭 Telegram 登录、移出允许列表或对应的账号改变后令牌失效
+		owner, err := telegramUser(t.TelegramID)
+		switch {
+		case errors.Is(err, errUserDisabled):
+			return nil, err
+		case err != nil || !telegramLogin || owner.Username != t.Username:
+			return nil, errTokenInvalid
+		}
+		u = owner
+	case t.Username == "":
+		if accessPwd == "" || !hmac.Equal([]byte(t.PwdTag), []byte(loginMAC("access_pwd", accessPwd))) {
+			return nil, errTokenInvalid
+		}
+		c := *sharedPwdUser
+		u = &c
+	default:
+		owner, err := catalog.GetUser(t.Username)
+		if err != nil {
+			return nil, errTokenInvalid
+		}
+		if owner.Disabled {
+			return nil, errUserDisabled
+		}
+		u = owner
+	}
+	u.token = t
+	return u, nil
+}
+
+// PutToken 保存令牌，hash 为令牌的 SHA-256
+func (c *Catalog) PutToken(hash string, t *APIToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTokens).Put([]byte(hash), data)
+	})
+}
+
+// GetToken 按令牌的 SHA-256 查询令牌
+func (c *Catalog) GetToken(hash string) (*APIToken, error) {
+	var t *APIToken
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketTokens).Get([]byte(hash))
+		if data == nil {
+			return errTokenNotFound
+		}
+		t = &APIToken{}
+		return json.Unmarshal(data, t)
+	})
+	return t, err
+}
+
+// ListTokens 列出令牌（不含 PwdTag），按创建时间倒序；keep 用于筛选
+func (c *Catalog) ListTokens(keep func(*APIToken) bool) ([]*APIToken, error) {
+	list := []*APIToken{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTokens).ForEach(func(_, v []byte) error {
+			t := &APIToken{}
+			if err := json.Unmarshal(v, t); err != nil {
+				return err
+			}
+			if keep(t) {
+				list = append(list, t.public())
+			}
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list, err
+}
+
+// DeleteToken 按 ID 删除令牌，allowed 返回 false 时视为不存在
+func (c *Catalog) DeleteToken(id string, allowed func(*APIToken) bool) (*APIToken, error) {
+	var t *APIToken
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTokens)
+		var key []byte
+		err := b.ForEach(func(k, v []byte) error {
+			cur := &APIToken{}
+			if json.Unmarshal(v, cur) == nil && cur.ID == id {
+				key, t = append([]byte(nil), k...), cur
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if t == nil || !allowed(t) {
+			return errTokenNotFound
+		}
+		return b.Delete(key)
+	})
+	return t, err
+}
+
+// tokenVisible 用户可以查看、撤销的令牌：管理员可以管理所有令牌
+func tokenVisible(u *User) func(*APIToken) bool {
+	return func(t *APIToken) bool {
+		return u.isAdmin() || t.Username == u.Username
+	}
+}
+
+// handleCreateToken POST /api/tokens，参数 name、scopes（read、upload、delete、share，逗号分隔）、expires_in（如 30d，可选）
+func handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permLogin)
+	if !ok {
+		return
+	}
+	scopes, err := parseScopes(r.FormValue("scopes"), u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := &APIToken{
+		ID:        newID(),
+		Name:      strings.TrimSpace(r.FormValue("name")),
+		Username:  u.Username,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	// 与登录会话相同：Telegram 登录的令牌绑定 Telegram 用户，ACCESS_PWD 的令牌绑定当前的访问密码
+	if u.login != nil && u.login.TelegramID != 0 {
+		t.TelegramID = u.login.TelegramID
+	} else if u.Username == "" {
+		t.PwdTag = loginMAC("access_pwd", accessPwd)
+	}
+	if v := r.FormValue("expires_in"); v != "" {
+		ttl, err := parseShareDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.ExpiresAt = t.CreatedAt.Add(ttl).Truncate(time.Second)
+	}
+	token := newAPIToken()
+	if err := catalog.PutToken(hashToken(token), t); err != nil {
+		http.Error(w, "保存 API 令牌失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("创建 API 令牌 %s (%s): %s", t.ID, t.Name, strings.Join(t.Scopes, ","))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, struct {
+		*APIToken
+		Token string `json:"token"` // 只在创建时返回
+	}{t.public(), token})
+}
+
+// handleListTokens GET /api/tokens
+func handleListTokens(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permLogin)
+	if !ok {
+		return
+	}
+	list, err := catalog.ListTokens(tokenVisible(u))
+	if err != nil {
+		http.Error(w, "读取 API 令牌失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// handleRevokeToken DELETE /api/tokens/{id}
+func handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permLogin)
+	if !ok {
+		return
+	}
+	t, err := catalog.DeleteToken(r.PathValue("id"), tokenVisible(u))
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	log.Printf("撤销 API 令牌 %s (%s)", t.ID, t.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	viewer := &User{Username: "v", Role: roleViewer}
+	uploader := &User{Username: "u", Role: roleUploader}
+	tests := []struct {
+		in      string
+		u       *User
+		want    []string
+		wantErr bool
+	}{
+		{"read", viewer, []string{scopeRead}, false},
+		{"read, upload,read", uploader, []string{scopeRead, scopeUpload}, false},
+		{"share", uploader, []string{scopeShare}, false},
+		{"share", viewer, nil, true},
+		{"upload", viewer, nil, true},
+		{"admin", sharedPwdUser, nil, true},
+		{" , ", uploader, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseScopes(tt.in, tt.u)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseScopes(%q, %s) = %v, %v; want %v, error %v", tt.in, tt.u.Role, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// 令牌只能执行 scopes 中的操作，分享需要单独的 share 权限
+func TestTokenScopes(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		scopes []string
+		perm   permission
+		want   int
+	}{
+		{[]string{scopeRead}, permRead, http.StatusOK},
+		{[]string{scopeRead}, permShare, http.StatusForbidden},
+		{[]string{scopeRead}, permUpload, http.StatusForbidden},
+		{[]string{scopeShare}, permShare, http.StatusOK},
+		{[]string{scopeShare}, permRead, http.StatusForbidden},
+		{[]string{scopeUpload, scopeDelete}, permDelete, http.StatusOK},
+		{[]string{scopeRead, scopeUpload, scopeDelete, scopeShare}, permLogin, http.StatusForbidden},
+		{[]string{scopeRead, scopeUpload, scopeDelete, scopeShare}, permAdmin, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		token := newAPIToken()
+		if err := catalog.PutToken(hashToken(token), &APIToken{ID: newID(), Scopes: tt.scopes, PwdTag: loginMAC("access_pwd", accessPwd)}); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		if _, ok := authorize(w, r, tt.perm); ok {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.want {
+			t.Errorf("scopes %v, permission %v: status %d, want %d", tt.scopes, tt.perm, w.Code, tt.want)
+		}
+	}
+}
+
+// telegramLoginCookie 为请求加上 Telegram 用户 7（管理员）的登录 Cookie
+func telegramLoginCookie(r *http.Request) {
+	s := newLoginSession(r, sharedPwdUser)
+	s.TelegramID = 7
+	w := httptest.NewRecorder()
+	saveLoginSession(w, r, s)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		create func(r *http.Request) // 设置创建令牌的请求的身份
+		change func()                // 创建令牌之后的修改
+		want   error
+		user   string
+	}{
+		{"访问密码", func(r *http.Request) { r.Header.Set("X-Access-Pwd", "secret") }, nil, nil, ""},
+		{"访问密码修改后失效", func(r *http.Request) { r.Header.Set("X-Access-Pwd", "secret") },
+			func() { accessPwd = "changed" }, errTokenInvalid, ""},
+		{"访问密码清空后失效", func(r *http.Request) { r.Header.Set("X-Access-Pwd", "secret") },
+			func() { accessPwd = "" }, errTokenInvalid, ""},
+		{"账号", func(r *http.Request) { r.SetBasicAuth("alice", "alice-secret") }, nil, nil, "alice"},
+		{"账号修改访问密码不影响", func(r *http.Request) { r.SetBasicAuth("alice", "alice-secret") },
+			func() { accessPwd = "changed" }, nil, "alice"},
+		{"账号停用后失效", func(r *http.Request) { r.SetBasicAuth("alice", "alice-secret") },
+			func() {
+				catalog.UpdateUser("alice", func(u *User) error { u.Disabled = true; return nil })
+			}, errUserDisabled, ""},
+		{"Telegram 登录", telegramLoginCookie, nil, nil, ""},
+		{"关闭 Telegram 登录后失效", telegramLoginCookie, func() { telegramLogin = false }, errTokenInvalid, ""},
+		{"移出 Telegram 允许列表后失效", telegramLoginCookie, func() { delete(telegramUsers, 7) }, errTokenInvalid, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			hash, err := hashUserPassword("alice-secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := catalog.CreateUser(&User{Username: "alice", PasswordHash: hash, Role: roleUploader}); err != nil {
+				t.Fatal(err)
+			}
+			oldLogin, oldUsers := telegramLogin, telegramUsers
+			telegramLogin, telegramUsers = true, map[int64]string{7: ""}
+			t.Cleanup(func() { telegramLogin, telegramUsers = oldLogin, oldUsers })
+
+			r := httptest.NewRequest(http.MethodPost, "/api/tokens?scopes=read", nil)
+			tt.create(r)
+			w := serve(http.HandlerFunc(handleCreateToken), r)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create token: status %d: %s", w.Code, w.Body)
+			}
+			var created struct {
+				Token  string `json:"token"`
+				PwdTag string `json:"pwd_tag"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+				t.Fatal(err)
+			}
+			if created.PwdTag != "" {
+				t.Error("pwd_tag returned by the API")
+			}
+			if tt.change != nil {
+				tt.change()
+			}
+			u, err := authenticateToken(created.Token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("authenticateToken() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && u.Username != tt.user {
+				t.Errorf("authenticateToken() user = %q, want %q", u.Username, tt.user)
+			}
+		})
+	}
+}
+
+func TestAuthenticateTokenStored(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		name string
+		t    *APIToken
+		want error
+	}{
+		{"有效", &APIToken{PwdTag: loginMAC("access_pwd", "secret")}, nil},
+		{"没有访问密码标记", &APIToken{}, errTokenInvalid},
+		{"已过期", &APIToken{PwdTag: loginMAC("access_pwd", "secret"), ExpiresAt: time.Now().Add(-time.Minute)}, errTokenExpired},
+		{"创建者不存在", &APIToken{Username: "nobody"}, errTokenInvalid},
+	}
+	for _, tt := range tests {
+		token := newAPIToken()
+		tt.t.ID, tt.t.Scopes = newID(), []string{scopeRead}
+		if err := catalog.PutToken(hashToken(token), tt.t); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := authenticateToken(token); !errors.Is(err, tt.want) {
+			t.Errorf("%s: authenticateToken() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if _, err := authenticateToken(newAPIToken()); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("unknown token: error = %v, want %v", err, errTokenInvalid)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tus 1.0 断点续传协议（https://tus.io/protocols/resumable-upload），支持 creation、termination 扩展。
+// 上传的数据按分片大小在本地缓冲，凑满一个分片就发送到 Telegram，会话状态持久化在 DATA_DIR/tus 下，
+// 因此浏览器断线或服务重启后都可以通过 HEAD 获取偏移量继续上传。
+const tusVersion = "1.0.0"
+
+var tusStore *TusStore
+
+// TusUpload 一个 tus 上传会话
+type TusUpload struct {
+	ID        string      `json:"id"`
+	Filename  string      `json:"filename"`
+	Path      string      `json:"path"`
+	Length    int64       `json:"length"`
+	ChunkSize int64       `json:"chunk_size"`
+	Chunks    []ChunkInfo `json:"chunks"`
+	NoDedup   bool        `json:"no_dedup,omitempty"`
+	// Visibility 创建时通过 Upload-Metadata 指定的文件可见性
+	Visibility Visibility `json:"visibility,omitempty"`
+	Uploader   string     `json:"uploader"`
+	Owner      string     `json:"owner,omitempty"` // 创建会话的用户，使用 ACCESS_PWD 时为空
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	// 上传完成后对应的文件目录记录
+	FileRecordID string `json:"file_record_id,omitempty"`
+	FileID       string `json:"file_id,omitempty"`
+}
+
+func (u *TusUpload) totalChunks() int {
+	return int((u.Length + u.ChunkSize - 1) / u.ChunkSize)
+}
+
+func (u *TusUpload) shippedSize() (size int64) {
+	for _, c := range u.Chunks {
+		size += c.Size
+	}
+	return
+}
+
+// TusStore 管理 tus 会话的持久化：{id}.json 保存状态，{id}.{index}.part 缓冲当前未满的分片
+type TusStore struct {
+	*stateDir
+}
+
+func openTusStore(dir string) (*TusStore, error) {
+	d, err := newStateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &TusStore{d}, nil
+}
+
+func (s *TusStore) partPath(id string, index int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s.%d.part", id, index))
+}
+
+func (s *TusStore) Load(id string) (*TusUpload, error) {
+	u := &TusUpload{}
+	if err := s.load(id, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *TusStore) Save(u *TusUpload) error {
+	u.UpdatedAt = time.Now()
+	return s.save(u.ID, u)
+}
+
+// Offset 当前已接收的字节数：已发送到 Telegram 的分片 + 本地缓冲的分片
+func (s *TusStore) Offset(u *TusUpload) int64 {
+	offset := u.shippedSize()
+	if fi, err := os.Stat(s.partPath(u.ID, len(u.Chunks))); err == nil {
+		offset += fi.Size()
+	}
+	return offset
+}
+
+// Remove 删除会话状态及所有缓冲文件
+func (s *TusStore) Remove(id string) error {
+	return s.remove(id)
+}
+
+// shipPart 将当前缓冲的分片发送到 Telegram 并记录，先保存状态再删除缓冲文件，
+// 这样重启后残留的旧缓冲文件（序号小于已记录分片数）不会被重复计入偏移量
+func (s *TusStore) shipPart(u *TusUpload) error {
+	index := len(u.Chunks)
+	partPath := s.partPath(u.ID, index)
+	info, err := sendChunkFile(partPath, chunkCaption(index, u.totalChunks(), u.Filename), u.Filename, !u.NoDedup)
+	if err != nil {
+		return err
+	}
+	u.Chunks = append(u.Chunks, info)
+	if err := s.Save(u); err != nil {
+		return err
+	}
+	return os.Remove(partPath)
+}
+
+// parseTusMetadata 解析 Upload-Metadata：逗号分隔的 "key base64value"
+func parseTusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
+
+// handleTus 处理 /tus/ 及 /tus/{id} 下的所有 tus 请求
+func handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "不支持的 Tus-Resumable 版本", http.StatusPreconditionFailed)
+		return
+	}
+	user, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tus"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		handleTusCreate(w, r, user)
+	case id != "" && r.Method == http.MethodHead:
+		handleTusHead(w, r, user, id)
+	case id != "" && r.Method == http.MethodPatch:
+		handleTusPatch(w, r, user, id)
+	case id != "" && r.Method == http.MethodDelete:
+		handleTusDelete(w, r, user, id)
+	default:
+		http.Error(w, "不支持的请求", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleTusCreate(w http.ResponseWriter, r *http.Request, user *User) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "缺少或无效的 Upload-Length", http.StatusBadRequest)
+		return
+	}
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	filename := filepath.Base(meta["filename"])
+	if !validName(filename) {
+		http.Error(w, "Upload-Metadata 中缺少 filename", http.StatusBadRequest)
+		return
+	}
+	var vis Visibility
+	if v := meta["visibility"]; v != "" {
+		if vis, err = parseVisibility(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	dir := user.abs(meta["path"])
+	if catalog.PathExists(path.Join(dir, filename)) {
+		http.Error(w, "目标路径已存在同名文件", http.StatusConflict)
+		return
+	}
+
+	u := &TusUpload{
+		ID:         newID(),
+		Filename:   filename,
+		Path:       dir,
+		Length:     length,
+		ChunkSize:  uploadChunkSize(),
+		Chunks:     []ChunkInfo{},
+		NoDedup:    meta["dedup"] == "0" || meta["dedup"] == "false",
+		Uploader:   user.actor(),
+		Owner:      user.Username,
+		Visibility: vis,
+		CreatedAt:  time.Now(),
+	}
+	if err := tusStore.Save(u); err != nil {
+		http.Error(w, "保存上传会话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("创建 tus 上传会话 %s: %s，大小 %d 字节", u.ID, filename, length)
+
+	w.Header().Set("Location", fmt.Sprintf("%s://%s/tus/%s", getScheme(r), r.Host, u.ID))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusHead(w http.ResponseWriter, r *http.Request, user *User, id string) {
+	unlock := tusStore.lock(id)
+	defer unlock()
+	u, err := tusStore.Load(id)
+	if err != nil || !user.canAccessUpload(u.Owner) {
+		http.Error(w, "上传会话不存在", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	offset := tusStore.Offset(u)
+	// 客户端看到偏移量等于上传大小就不会再发送 PATCH，由 HEAD 补完最后一个分片发送失败的上传
+	if offset == u.Length && u.FileID == "" {
+		if err := finishTusUpload(u); err != nil {
+			log.Printf("tus 会话 %s 完成上传失败: %v", u.ID, err)
+			writeTusFinishError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	setTusResultHeaders(w, r, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleTusPatch(w http.ResponseWriter, r *http.Request, user *User, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type 必须为 application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	unlock := tusStore.lock(id)
+	defer unlock()
+	u, err := tusStore.Load(id)
+	if err != nil || !user.canAccessUpload(u.Owner) {
+		http.Error(w, "上传会话不存在", http.StatusNotFound)
+		return
+	}
+	offset := tusStore.Offset(u)
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, "Upload-Offset 与服务端不一致", http.StatusConflict)
+		return
+	}
+
+	body := io.LimitReader(r.Body, u.Length-offset)
+	for offset < u.Length {
+		// 每次最多写到当前分片的边界
+		partPath := tusStore.partPath(u.ID, len(u.Chunks))
+		partSize := offset - u.shippedSize()
+		want := min(u.ChunkSize-partSize, u.Length-offset)
+
+		part, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			http.Error(w, "写入缓冲失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, copyErr := io.CopyN(part, body, want)
+		part.Close()
+		offset += n
+
+		if partSize+n == u.ChunkSize || offset == u.Length {
+			if err := tusStore.shipPart(u); err != nil {
+				log.Printf("tus 会话 %s 发送分片失败: %v", u.ID, err)
+				w.Header().Set("Upload-Offset", strconv.FormatInt(tusStore.Offset(u), 10))
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+		if copyErr != nil {
+			// 请求体读完或客户端断开，已写入的数据保留，客户端可通过 HEAD 继续
+			break
+		}
+	}
+
+	if offset == u.Length && u.FileID == "" {
+		if err := finishTusUpload(u); err != nil {
+			log.Printf("tus 会话 %s 完成上传失败: %v", u.ID, err)
+			w.Header().Set("Upload-Offset", strconv.FormatInt(tusStore.Offset(u), 10))
+			writeTusFinishError(w, err)
+			return
+		}
+	} else if err := tusStore.Save(u); err != nil {
+		log.Printf("保存 tus 会话 %s 失败: %v", u.ID, err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	setTusResultHeaders(w, r, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload 数据全部接收后写入文件目录。上一次请求发送最后一个分片失败时缓冲文件仍留在本地，
+// 偏移量已经等于上传大小，这里先补发该分片，确认所有分片都已发送后才提交
+func finishTusUpload(u *TusUpload) error {
+	if u.shippedSize() < u.Length {
+		if err := tusStore.shipPart(u); err != nil {
+			return err
+		}
+	}
+	if size := u.shippedSize(); size != u.Length {
+		return fmt.Errorf("已发送 %d 字节，与上传大小 %d 不一致", size, u.Length)
+	}
+	manifest := newManifest(u.Filename, u.Chunks)
+	rec, err := commitManifest(manifest, u.Path, u.Uploader, u.Visibility)
+	if err != nil {
+		return err
+	}
+	u.FileRecordID, u.FileID = rec.ID, rec.FileID
+	if err := tusStore.Save(u); err != nil {
+		log.Printf("保存 tus 会话 %s 失败: %v", u.ID, err)
+	}
+	log.Printf("tus 上传完成 %s: %s", u.ID, u.Filename)
+	return nil
+}
+
+// writeTusFinishError 目标路径在创建会话之后被占用时返回 409，客户端可以 DELETE 终止上传；其余为发送到 Telegram 失败
+func writeTusFinishError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errPathExists) {
+		writeCatalogError(w, err)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// handleTusDelete 终止上传：未完成的上传同时删除已发送的分块消息，仍被文件目录或其他上传会话引用（去重）的保留；
+// 删除失败时保留会话，客户端可以重试，否则超过宽限期后由孤儿分块回收继续清理
+func handleTusDelete(w http.ResponseWriter, r *http.Request, user *User, id string) {
+	unlock := tusStore.lock(id)
+	defer unlock()
+	u, err := tusStore.Load(id)
+	if err != nil || !user.canAccessUpload(u.Owner) {
+		http.Error(w, "上传会话不存在", http.StatusNotFound)
+		return
+	}
+	if u.FileID == "" {
+		if err := deleteTusChunks(u); err != nil {
+			http.Error(w, "删除已上传的分块失败: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	if err := tusStore.Remove(id); err != nil && !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "删除上传会话失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteTusChunks 删除未完成的 tus 上传已发送到 Telegram、且没有被其他地方引用的分块
+func deleteTusChunks(u *TusUpload) error {
+	refs, err := collectBlobRefs(u.ID, time.Time{})
+	if err != nil {
+		return fmt.Errorf("读取文件目录失败: %w", err)
+	}
+	var lastErr error
+	deleted := 0
+	for _, c := range u.Chunks {
+		if c.FileID == "" || refs.has(c) {
+			continue
+		}
+		if err := deleteBlob(c); err != nil {
+			lastErr = err
+			continue
+		}
+		deleted++
+	}
+	log.Printf("终止 tus 上传 %s: %s，删除分块消息 %d 条", u.ID, u.Filename, deleted)
+	return lastErr
+}
+
+// setTusResultHeaders 上传完成后在响应头中返回文件 ID 及下载链接
+func setTusResultHeaders(w http.ResponseWriter, r *http.Request, u *TusUpload) {
+	if u.FileID == "" {
+		return
+	}
+	w.Header().Set("X-File-Id", u.FileID)
+	w.Header().Set("X-Download-Url", manifestLink(getScheme(r)+"://"+r.Host, u.FileRecordID, u.FileID))
+}
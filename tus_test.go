@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{"filename YS50eHQ=", map[string]string{"filename": "a.txt"}},
+		{"filename YS50eHQ=, path L2RvY3M=,visibility cHJpdmF0ZQ==", map[string]string{"filename": "a.txt", "path": "/docs", "visibility": "private"}},
+		{"is_confidential", map[string]string{"is_confidential": ""}},
+		{"", map[string]string{}},
+	}
+	for _, tt := range tests {
+		got := parseTusMetadata(tt.header)
+		if len(got) != len(tt.want) {
+			t.Errorf("parseTusMetadata(%q) = %v, want %v", tt.header, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("parseTusMetadata(%q)[%s] = %q, want %q", tt.header, k, got[k], v)
+			}
+		}
+	}
+}
+
+// 终止上传时删除已发送的分块，仍被文件目录引用（去重）的分块保留
+func TestTusDeleteShippedChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		shared    bool // 第一个分块同时被文件目录中的记录引用
+		completed bool
+		deleted   []int // 应被删除的分块序号
+	}{
+		{"未完成的上传", false, false, []int{0, 1}},
+		{"与已有文件共用分块", true, false, []int{1}},
+		{"已完成的上传", false, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := setupTest(t)
+			u := &TusUpload{ID: newID(), Filename: "a.bin", Path: "/", Length: 20, ChunkSize: 8}
+			for _, data := range []string{"chunk-00", "chunk-01"} {
+				fileID, messageID := tg.upload([]byte(data))
+				u.Chunks = append(u.Chunks, ChunkInfo{FileID: fileID, MessageID: messageID, Size: 8})
+			}
+			if tt.shared {
+				c := u.Chunks[0]
+				if err := catalog.PutFile(&FileRecord{Filename: "b.bin", Path: "/", Chunked: true, FileID: "manifest", Chunks: []ChunkInfo{c}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.completed {
+				u.FileID = "manifest"
+			}
+			if err := tusStore.Save(u); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodDelete, "/tus/"+u.ID, nil)
+			r.Header.Set("Tus-Resumable", tusVersion)
+			r.Header.Set("X-Access-Pwd", "secret")
+			if w := serve(http.HandlerFunc(handleTus), r); w.Code != http.StatusNoContent {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var want []int
+			for _, i := range tt.deleted {
+				want = append(want, u.Chunks[i].MessageID)
+			}
+			if got := tg.deletedMessages(); !slices.Equal(got, want) {
+				t.Errorf("deleted messages %v, want %v", got, want)
+			}
+			if _, err := tusStore.Load(u.ID); err == nil {
+				t.Error("tus upload not removed")
+			}
+		})
+	}
+}
+
+// tusRequest 以访问密码发送 tus 请求，PATCH 时 body 从 offset 处写入
+func tusRequest(method, target string, offset int, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("X-Access-Pwd", "secret")
+	if method == http.MethodPatch {
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+		r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	}
+	return serve(http.HandlerFunc(handleTus), r)
+}
+
+// createTusUpload 创建上传到 /a.bin 的 tus 会话，分片大小为 chunkSize，返回会话的路径
+func createTusUpload(t *testing.T, length int, chunkSize int64) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/tus/", nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("X-Access-Pwd", "secret")
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "filename YS5iaW4=")
+	w := serve(http.HandlerFunc(handleTus), r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	id := path.Base(w.Header().Get("Location"))
+	u, err := tusStore.Load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.ChunkSize = chunkSize
+	if err := tusStore.Save(u); err != nil {
+		t.Fatal(err)
+	}
+	return "/tus/" + id
+}
+
+// 最后一个分片发送失败后，重试的 PATCH 或 HEAD 补发该分片再提交，下载到完整的文件
+func TestTusRetryLastChunk(t *testing.T) {
+	data := "0123456789ab"
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"重试 PATCH", http.MethodPatch, http.StatusNoContent},
+		{"恢复时 HEAD", http.MethodHead, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := setupTest(t)
+			target := createTusUpload(t, len(data), 8)
+			if w := tusRequest(http.MethodPatch, target, 0, data[:8]); w.Code != http.StatusNoContent {
+				t.Fatalf("first PATCH: status %d: %s", w.Code, w.Body)
+			}
+			tg.failSends(1)
+			if w := tusRequest(http.MethodPatch, target, 8, data[8:]); w.Code != http.StatusBadGateway {
+				t.Fatalf("failing PATCH: status %d, want %d", w.Code, http.StatusBadGateway)
+			}
+			if w := tusRequest(tt.method, target, len(data), ""); w.Code != tt.status || w.Header().Get("X-File-Id") == "" {
+				t.Fatalf("retry: status %d, X-File-Id %q: %s", w.Code, w.Header().Get("X-File-Id"), w.Body)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/d?path=/a.bin", nil)
+			r.Header.Set("X-Access-Pwd", "secret")
+			w := serve(http.HandlerFunc(handleDownload), r)
+			if w.Code != http.StatusOK || w.Body.String() != data {
+				t.Errorf("download: status %d, body %q; want %q", w.Code, w.Body, data)
+			}
+		})
+	}
+}
+
+// 创建会话之后目标路径被占用，完成上传时返回 409，不写入文件目录，清单消息被删除
+func TestTusPathTaken(t *testing.T) {
+	tg := setupTest(t)
+	target := createTusUpload(t, 4, 8)
+	if err := catalog.PutFile(&FileRecord{Filename: "a.bin", Path: "/", FileID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := tusRequest(http.MethodPatch, target, 0, "data"); w.Code != http.StatusConflict {
+		t.Fatalf("PATCH: status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	rec, err := catalog.GetFileByPath("/a.bin")
+	if err != nil || rec.FileID != "other" {
+		t.Errorf("GetFileByPath() = %+v, %v; want the existing file", rec, err)
+	}
+	// 分块消息 1 保留，清单消息 2 被删除
+	if got := tg.deletedMessages(); !slices.Equal(got, []int{2}) {
+		t.Errorf("deleted messages %v, want [2]", got)
+	}
+	u, err := tusStore.Load(path.Base(target))
+	if err != nil || u.FileID != "" {
+		t.Errorf("tus upload = %+v, %v; want unfinished", u, err)
+	}
+}
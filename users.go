@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 多用户：每个用户有自己的用户名、密码（bcrypt 哈希）和角色，非管理员只能看到自己的目录 /home/{用户名}，
+// 接口中的路径都相对于该目录。ACCESS_PWD 仍可作为管理员密码使用（不带用户名登录），未创建用户时即为单密码模式。
+type Role string
+
+const (
+	roleViewer   Role = "viewer"   // 只能浏览和下载
+	roleUploader Role = "uploader" // 可以上传、整理、分享自己的文件
+	roleAdmin    Role = "admin"    // 可以访问所有文件、管理用户、执行回收
+
+	// homeDir 非管理员用户的目录都在该目录下
+	homeDir = "/home"
+	// minPasswordLength 用户密码的最小长度
+	minPasswordLength = 8
+)
+
+var (
+	bucketUsers = []byte("users") // 用户名 -> User JSON
+
+	errUserNotFound = errors.New("用户不存在")
+	errUserExists   = errors.New("用户名已存在")
+	errUnauthorized = errors.New("用户名或密码错误")
+	errUserDisabled = errors.New("账号已停用")
+	errForbidden    = errors.New("权限不足")
+
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+	// sharedPwdUser 使用 ACCESS_PWD 登录时的身份
+	sharedPwdUser = &User{Role: roleAdmin}
+)
+
+// level 角色的权限等级，高等级包含低等级的全部权限
+func (r Role) level() int {
+	switch r {
+	case roleViewer:
+		return 1
+	case roleUploader:
+		return 2
+	case roleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// User 用户账号
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash,omitempty"` // bcrypt 哈希，接口返回时清空
+	Role         Role      `json:"role"`
+	Disabled     bool      `json:"disabled,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	// Provider、Issuer、Subject 通过单点登录创建的账号对应的登录方式、身份提供方（iss）及其用户 ID（sub）
+	Provider string `json:"provider,omitempty"`
+	Issuer   string `json:"issuer,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+
+	token *APIToken     // 通过 API 令牌认证时使用的令牌
+	login *LoginSession // 通过登录 Cookie 认证时的登录会话
+}
+
+// public 返回不含密码哈希的副本，用于接口输出
+func (u *User) public() *User {
+	c := *u
+	c.PasswordHash = ""
+	return &c
+}
+
+func (u *User) can(role Role) bool {
+	return u.Role.level() >= role.level()
+}
+
+func (u *User) isAdmin() bool {
+	return u.Role == roleAdmin
+}
+
+// actor 记录在文件、分享链接上的操作者：账号的用户名，通过 Telegram 登录的管理员为 "telegram:用户 ID"，
+// 使用 ACCESS_PWD 时为 "ACCESS_PWD"（用户名只能是小写，不会冲突）
+func (u *User) actor() string {
+	switch {
+	case u.Username != "":
+		return u.Username
+	case u.login != nil && u.login.TelegramID != 0:
+		return fmt.Sprintf("telegram:%d", u.login.TelegramID)
+	}
+	return "ACCESS_PWD"
+}
+
+// root 用户可见的目录树根：管理员为 /，其他用户为 /home/{用户名}
+func (u *User) root() string {
+	if u.isAdmin() {
+		return "/"
+	}
+	return path.Join(homeDir, u.Username)
+}
+
+// abs 将用户提交的路径转换为目录中的完整路径（不会超出用户的根目录）
+func (u *User) abs(p string) string {
+	return path.Join(u.root(), cleanPath(p))
+}
+
+// rel 将目录中的完整路径转换为用户看到的路径
+func (u *User) rel(p string) string {
+	if u.isAdmin() {
+		return p
+	}
+	return cleanPath(strings.TrimPrefix(p, u.root()))
+}
+
+// owns 文件是否在用户的目录下
+func (u *User) owns(rec *FileRecord) bool {
+	return isUnder(cleanPath(rec.Path), u.root())
+}
+
+// viewFile 返回路径相对于用户根目录的文件记录副本
+func (u *User) viewFile(rec *FileRecord) *FileRecord {
+	c := *rec
+	c.Path = u.rel(cleanPath(rec.Path))
+	c.Visibility = rec.visibility()
+	return &c
+}
+
+// viewListing 将目录列表中的路径转换为相对于用户根目录的路径
+func (u *User) viewListing(listing *FolderListing) *FolderListing {
+	listing.Path = u.rel(listing.Path)
+	for _, f := range listing.Folders {
+		f.Path = u.rel(f.Path)
+	}
+	for i, rec := range listing.Files {
+		listing.Files[i] = u.viewFile(rec)
+	}
+	return listing
+}
+
+// getUserFile 按记录 ID 或 file_id 查询用户目录下的文件，其他用户的文件视为不存在
+func getUserFile(u *User, id string) (*FileRecord, error) {
+	rec, err := catalog.GetFile(id)
+	if err != nil {
+		return nil, err
+	}
+	if !u.owns(rec) {
+		return nil, errFileNotFound
+	}
+	return rec, nil
+}
+
+// canAccessUpload 上传会话是否属于该用户，管理员可以访问所有会话
+func (u *User) canAccessUpload(owner string) bool {
+	return u.isAdmin() || owner == u.Username
+}
+
+func validRole(role Role) bool {
+	return role.level() > 0
+}
+
+func hashUserPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errors.New("密码至少需要 8 个字符")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", errors.New("密码不能超过 72 个字节")
+	}
+	return string(hash), err
+}
+
+// CreateUser 创建用户及其个人目录 /home/{用户名}
+func (c *Catalog) CreateUser(u *User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers)
+		if b.Get([]byte(u.Username)) != nil {
+			return errUserExists
+		}
+		if err := ensureFolderTx(tx, path.Join(homeDir, u.Username)); err != nil {
+			return err
+		}
+		return b.Put([]byte(u.Username), data)
+	})
+}
+
+// GetUser 按用户名查询用户
+func (c *Catalog) GetUser(username string) (*User, error) {
+	var u *User
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketUsers).Get([]byte(username))
+		if data == nil {
+			return errUserNotFound
+		}
+		u = &User{}
+		return json.Unmarshal(data, u)
+	})
+	return u, err
+}
+
+// ListUsers 按用户名列出所有用户（不含密码哈希）
+func (c *Catalog) ListUsers() ([]*User, error) {
+	list := []*User{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsers).ForEach(func(_, v []byte) error {
+			u := &User{}
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			list = append(list, u.public())
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+	return list, err
+}
+
+// HasUsers 是否已创建过用户
+func (c *Catalog) HasUsers() bool {
+	has := false
+	c.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(bucketUsers).Cursor().First()
+		has = k != nil
+		return nil
+	})
+	return has
+}
+
+// UpdateUser 在同一事务中读取、修改并保存用户
+func (c *Catalog) UpdateUser(username string, fn func(*User) error) (*User, error) {
+	var u *User
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers)
+		data := b.Get([]byte(username))
+		if data == nil {
+			return errUserNotFound
+		}
+		u = &User{}
+		if err := json.Unmarshal(data, u); err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(username), data)
+	})
+	return u, err
+}
+
+// authenticate 识别请求的用户：优先使用 Authorization: Bearer 传递的 API 令牌；
+// 用户名、密码可以通过表单参数 user、pwd，请求头 X-Access-User、X-Access-Pwd 或 HTTP Basic 认证传递，
+// 不带用户名时按 ACCESS_PWD 校验，通过后为管理员；没有提交密码时使用登录 Cookie
+func authenticate(r *http.Request) (*User, error) {
+	ip := clientIP(r)
+	if token, ok := bearerToken(r); ok {
+		if err := authGuard.check(ip); err != nil {
+			return nil, err
+		}
+		u, err := authenticateToken(token)
+		authGuard.record(ip, err)
+		return u, err
+	}
+	username, password := r.FormValue("user"), r.FormValue("pwd")
+	if username == "" {
+		username = r.Header.Get("X-Access-User")
+	}
+	if password == "" {
+		password = r.Header.Get("X-Access-Pwd")
+	}
+	if u, p, ok := r.BasicAuth(); ok {
+		username, password = u, p
+	}
+	if password == "" {
+		if u, ok, err := authenticateCookie(r); ok {
+			return u, err
+		}
+		return nil, errUnauthorized
+	}
+	if err := authGuard.check(ip); err != nil {
+		return nil, err
+	}
+	u, err := checkPassword(username, password)
+	authGuard.record(ip, err)
+	return u, err
+}
+
+// checkPassword 校验用户名和密码，用户名为空时校验 ACCESS_PWD
+func checkPassword(username, password string) (*User, error) {
+	if username == "" {
+		if accessPwd != "" && secureCompare(password, accessPwd) {
+			return sharedPwdUser, nil
+		}
+		return nil, errUnauthorized
+	}
+	u, err := catalog.GetUser(strings.ToLower(username))
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return nil, errUnauthorized
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, errUnauthorized
+	}
+	if u.Disabled {
+		return nil, errUserDisabled
+	}
+	return u, nil
+}
+
+// permission 接口要求的最低角色，以及使用 API 令牌时需要的权限范围（为空表示不能使用 API 令牌）
+type permission struct {
+	role  Role
+	scope string
+}
+
+var (
+	permRead   = permission{roleViewer, scopeRead}     // 浏览、查询、校验文件
+	permUpload = permission{roleUploader, scopeUpload} // 上传、整理文件
+	permDelete = permission{roleUploader, scopeDelete} // 删除文件、目录
+	permShare  = permission{roleUploader, scopeShare}  // 创建分享链接、签名链接
+	permAdmin  = permission{roleAdmin, ""}             // 管理用户、执行回收
+	permLogin  = permission{roleViewer, ""}            // 管理自己的 API 令牌
+)
+
+// authorize 校验请求的用户满足权限 p，失败时写入 401/403 响应
+func authorize(w http.ResponseWriter, r *http.Request, p permission) (*User, bool) {
+	u, err := authenticate(r)
+	if err != nil {
+		writeAuthError(w, err)
+		return nil, false
+	}
+	if !u.can(p.role) {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	if u.token != nil && !u.token.allows(p.scope) {
+		http.Error(w, errTokenScope.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	return u, true
+}
+
+// handleListUsers GET /api/users
+func handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, permAdmin); !ok {
+		return
+	}
+	list, err := catalog.ListUsers()
+	if err != nil {
+		http.Error(w, "读取用户失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// handleCreateUser POST /api/users，参数 username、password、role（viewer、uploader、admin，默认 uploader）
+func handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, permAdmin); !ok {
+		return
+	}
+	username := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+	if !usernamePattern.MatchString(username) {
+		http.Error(w, "用户名只能包含小写字母、数字、_ . -，且不超过 32 个字符", http.StatusBadRequest)
+		return
+	}
+	role := Role(r.FormValue("role"))
+	if role == "" {
+		role = roleUploader
+	}
+	if !validRole(role) {
+		http.Error(w, "role 参数无效，应为 viewer、uploader 或 admin", http.StatusBadRequest)
+		return
+	}
+	hash, err := hashUserPassword(r.FormValue("password"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u := &User{Username: username, PasswordHash: hash, Role: role, CreatedAt: time.Now()}
+	if err := catalog.CreateUser(u); err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	log.Printf("创建用户 %s (%s)", u.Username, u.Role)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, u.public())
+}
+
+// handleUpdateUser POST /api/users/{name}，参数 role、password，只修改提交了的项
+func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authorize(w, r, permAdmin)
+	if !ok {
+		return
+	}
+	role := Role(r.FormValue("role"))
+	if role != "" && !validRole(role) {
+		http.Error(w, "role 参数无效，应为 viewer、uploader 或 admin", http.StatusBadRequest)
+		return
+	}
+	if role != "" && role != roleAdmin && r.PathValue("name") == admin.Username {
+		http.Error(w, "不能降低自己的角色", http.StatusBadRequest)
+		return
+	}
+	var hash string
+	if password := r.FormValue("password"); password != "" {
+		var err error
+		if hash, err = hashUserPassword(password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	u, err := catalog.UpdateUser(r.PathValue("name"), func(u *User) error {
+		if role != "" {
+			u.Role = role
+		}
+		if hash != "" {
+			u.PasswordHash = hash
+		}
+		return nil
+	})
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	if hash != "" {
+		revokeLoginSessions(u.Username)
+	}
+	log.Printf("更新用户 %s (%s)", u.Username, u.Role)
+	writeJSON(w, u.public())
+}
+
+// handleDisableUser POST /api/users/{name}/disable 停用用户，POST /api/users/{name}/enable 重新启用
+func handleDisableUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authorize(w, r, permAdmin)
+	if !ok {
+		return
+	}
+	disabled := strings.HasSuffix(r.URL.Path, "/disable")
+	if disabled && r.PathValue("name") == admin.Username {
+		http.Error(w, "不能停用自己的账号", http.StatusBadRequest)
+		return
+	}
+	u, err := catalog.UpdateUser(r.PathValue("name"), func(u *User) error {
+		u.Disabled = disabled
+		return nil
+	})
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	if disabled {
+		revokeLoginSessions(u.Username)
+		log.Printf("停用用户 %s", u.Username)
+	} else {
+		log.Printf("启用用户 %s", u.Username)
+	}
+	writeJSON(w, u.public())
+}
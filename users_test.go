@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+// 上传的文件、分片上传会话、tus 上传记录的上传者为操作者的用户名，而不是来源 IP
+func TestUploaderRecorded(t *testing.T) {
+	identities := []struct {
+		name string
+		auth func(r *http.Request)
+		want string
+	}{
+		{"访问密码", func(r *http.Request) { r.Header.Set("X-Access-Pwd", "secret") }, "ACCESS_PWD"},
+		{"账号", func(r *http.Request) { r.SetBasicAuth("alice", "alice-secret") }, "alice"},
+		{"Telegram 登录", telegramLoginCookie, "telegram:7"},
+	}
+	direct := func(t *testing.T, auth func(*http.Request)) string {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		fw.Write([]byte("hello"))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		auth(r)
+		w := serve(http.HandlerFunc(handleUpload), r)
+		var res UploadResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+		}
+		rec, err := catalog.GetFileByPublicID(res.PublicID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Uploader
+	}
+	uploads := []struct {
+		name   string
+		upload func(t *testing.T, auth func(*http.Request)) string // 返回记录的上传者
+	}{
+		{"直接上传", direct},
+		{"开启加密后直接上传", func(t *testing.T, auth func(*http.Request)) string {
+			withEncryptionKey(t, "k1")
+			return direct(t, auth)
+		}},
+		{"压缩后直接上传", func(t *testing.T, auth func(*http.Request)) string {
+			oldAlg := compressionAlg
+			compressionAlg = compressionGzip
+			t.Cleanup(func() { compressionAlg = oldAlg })
+			return direct(t, auth)
+		}},
+		{"分片上传会话", func(t *testing.T, auth func(*http.Request)) string {
+			r := httptest.NewRequest(http.MethodPost, "/upload_session", strings.NewReader("filename=a.bin&size=5"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			auth(r)
+			w := serve(http.HandlerFunc(handleUploadSession), r)
+			var st SessionStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("create session: status %d: %s", w.Code, w.Body)
+			}
+			sess, err := sessionStore.Load(st.SessionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sess.Uploader
+		}},
+		{"tus", func(t *testing.T, auth func(*http.Request)) string {
+			r := httptest.NewRequest(http.MethodPost, "/tus/", nil)
+			r.Header.Set("Tus-Resumable", tusVersion)
+			r.Header.Set("Upload-Length", "5")
+			r.Header.Set("Upload-Metadata", "filename YS5iaW4=")
+			auth(r)
+			w := serve(http.HandlerFunc(handleTus), r)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create tus upload: status %d: %s", w.Code, w.Body)
+			}
+			u, err := tusStore.Load(path.Base(w.Header().Get("Location")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return u.Uploader
+		}},
+	}
+	for _, id := range identities {
+		for _, up := range uploads {
+			t.Run(id.name+"/"+up.name, func(t *testing.T) {
+				setupTest(t)
+				hash, err := hashUserPassword("alice-secret")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := catalog.CreateUser(&User{Username: "alice", PasswordHash: hash, Role: roleUploader}); err != nil {
+					t.Fatal(err)
+				}
+				oldLogin, oldUsers := telegramLogin, telegramUsers
+				telegramLogin, telegramUsers = true, map[int64]string{7: ""}
+				t.Cleanup(func() { telegramLogin, telegramUsers = oldLogin, oldUsers })
+
+				if got := up.upload(t, id.auth); got != id.want {
+					t.Errorf("uploader = %q, want %q", got, id.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// integrityError 分块内容与上传时记录的 SHA-256 不一致
+type integrityError struct {
+	index    int
+	fileID   string
+	expected string
+	actual   string
+}
+
+func (e *integrityError) Error() string {
+	return fmt.Sprintf("分块 %d 校验失败，期望 SHA-256 %s，实际 %s", e.index+1, e.expected, e.actual)
+}
+
+// reportDownloadError 记录下载中止原因，校验失败时额外通过机器人告警
+func reportDownloadError(filename string, err error) {
+	log.Printf("下载 %s 中止: %v", filename, err)
+	var integrityErr *integrityError
+	if errors.As(err, &integrityErr) {
+		alertIntegrity(filename, integrityErr)
+	}
+}
+
+func alertIntegrity(filename string, e *integrityError) {
+	text := fmt.Sprintf("⚠️文件完整性校验失败\n\n文件：%s\n分块：%d\nfile_id：%s\n期望：%s\n实际：%s",
+		filename, e.index+1, e.fileID, e.expected, e.actual)
+	if _, err := bot.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+		log.Println("发送校验告警失败:", err)
+	}
+}
+
+// ChunkHealth 单个分块的校验结果
+type ChunkHealth struct {
+	Index          int    `json:"index"`
+	FileID         string `json:"file_id"`
+	Size           int64  `json:"size"`
+	ActualSize     int64  `json:"actual_size"`
+	ExpectedSHA256 string `json:"expected_sha256,omitempty"`
+	ActualSHA256   string `json:"actual_sha256,omitempty"`
+	Status         string `json:"status"` // ok / mismatch / error / unverified
+	Error          string `json:"error,omitempty"`
+}
+
+// VerifyReport 整个文件的校验结果
+type VerifyReport struct {
+	FileID    string        `json:"file_id"`
+	Filename  string        `json:"filename"`
+	Status    string        `json:"status"` // ok / corrupted / unverified
+	CheckedAt time.Time     `json:"checked_at"`
+	Chunks    []ChunkHealth `json:"chunks"`
+}
+
+// resolveFileChunks 获取文件的分块列表：优先使用文件目录，否则按 /d 的规则（有 filename 为单文件，否则为清单）
+func resolveFileChunks(ctx context.Context, fileID, filename string) (string, *Manifest, error) {
+	if rec, err := catalog.GetFile(fileID); err == nil {
+		if rec.Chunked {
+			m, err := fetchManifest(ctx, rec.FileID)
+			return rec.FileID, m, err
+		}
+		return rec.FileID, &Manifest{
+			Filename: rec.Filename,
+			Size:     rec.Size,
+			Chunks:   []ChunkInfo{{FileID: rec.FileID, Size: rec.Size, SHA256: rec.SHA256}},
+		}, nil
+	}
+	if filename != "" {
+		tgFile, err := getTelegramFile(fileID)
+		if err != nil {
+			return fileID, nil, err
+		}
+		size := int64(tgFile.FileSize)
+		return fileID, &Manifest{
+			Filename: filename,
+			Size:     size,
+			Chunks:   []ChunkInfo{{FileID: fileID, Size: size}},
+		}, nil
+	}
+	m, err := fetchManifest(ctx, fileID)
+	return fileID, m, err
+}
+
+// verifyChunks 并发重新下载所有分块并计算哈希，不向客户端传输数据。
+// 压缩、加密的分块需要整个读入内存还原，与下载相同按 DOWNLOAD_BUFFER_MB 限制占用的内存
+func verifyChunks(ctx context.Context, chunks []ChunkInfo) []ChunkHealth {
+	results := make([]ChunkHealth, len(chunks))
+	workers := max(1, min(downloadThreads, len(chunks)))
+	sem := make(chan struct{}, workers)
+	memLimit := int64(downloadBufferMB) << 20 / int64(workers)
+	decodeSlot := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for i, c := range chunks {
+		wg.Add(1)
+		go func(i int, c ChunkInfo) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			health := ChunkHealth{Index: i, FileID: c.FileID, Size: c.Size, ExpectedSHA256: c.SHA256}
+			defer func() { results[i] = health }()
+
+			hasher := sha256.New()
+			if encodedChunk(c) {
+				// 压缩或加密的分块：还原后校验原始内容，认证或解压失败即视为损坏
+				data, release, err := downloadEncoded(ctx, c.FileID, c, memLimit, decodeSlot)
+				if err != nil {
+					health.Status, health.Error = "error", err.Error()
+					return
+				}
+				if release != nil {
+					defer release()
+				}
+				if data, err = decodeChunk(c, data); err != nil {
+					health.Status, health.Error = "mismatch", err.Error()
+					if errors.Is(err, errUnknownKey) {
+						health.Status = "error"
+					}
+					return
+				}
+				hasher.Write(data)
+				health.ActualSize = int64(len(data))
+			} else {
+				body, err := openBlob(ctx, c.FileID, 0, -1)
+				if err != nil {
+					health.Status, health.Error = "error", err.Error()
+					return
+				}
+				defer body.Close()
+				if health.ActualSize, err = io.Copy(hasher, body); err != nil {
+					health.Status, health.Error = "error", err.Error()
+					return
+				}
+			}
+			health.ActualSHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+			switch {
+			case c.Size > 0 && health.ActualSize != c.Size:
+				health.Status = "mismatch"
+				health.Error = fmt.Sprintf("大小不一致: %d/%d 字节", health.ActualSize, c.Size)
+			case c.SHA256 == "":
+				health.Status = "unverified"
+			case c.SHA256 != health.ActualSHA256:
+				health.Status = "mismatch"
+			default:
+				health.Status = "ok"
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	return results
+}
+
+// handleVerifyFile GET /verify_file?file_id=，重新下载全部分块并返回每个分块的健康状况
+func handleVerifyFile(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permRead)
+	if !ok {
+		return
+	}
+	fileID := r.FormValue("file_id")
+	if fileID == "" {
+		http.Error(w, "缺少 file_id 参数", http.StatusBadRequest)
+		return
+	}
+	// 不在文件目录中的文件只有管理员可以校验
+	if _, err := getUserFile(u, fileID); err != nil && !u.isAdmin() {
+		writeCatalogError(w, errFileNotFound)
+		return
+	}
+
+	fileID, manifest, err := resolveFileChunks(r.Context(), fileID, r.FormValue("filename"))
+	if err != nil {
+		http.Error(w, "获取文件信息失败: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	report := VerifyReport{
+		FileID:    fileID,
+		Filename:  manifest.Filename,
+		Status:    "ok",
+		CheckedAt: time.Now(),
+		Chunks:    verifyChunks(r.Context(), manifest.Chunks),
+	}
+	for _, c := range report.Chunks {
+		if c.Status == "mismatch" || c.Status == "error" {
+			report.Status = "corrupted"
+			break
+		}
+		if c.Status == "unverified" {
+			report.Status = "unverified"
+		}
+	}
+	log.Printf("校验文件 %s (%s): %s", manifest.Filename, fileID, report.Status)
+	writeJSON(w, report)
+}
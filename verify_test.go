@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+)
+
+// 压缩、加密的分块超过下载缓冲时经临时文件校验，结果与在内存中校验一致
+func TestVerifyChunks(t *testing.T) {
+	tg := setupTest(t)
+	withEncryptionKey(t, "k1")
+	oldBuffer, oldThreads := downloadBufferMB, downloadThreads
+	downloadBufferMB, downloadThreads = 1, 4
+	t.Cleanup(func() { downloadBufferMB, downloadThreads = oldBuffer, oldThreads })
+
+	plain := bytes.Repeat([]byte("tg-disk verify "), 20<<10)
+	tests := []struct {
+		name    string
+		alg     string
+		encrypt bool
+		tamper  func(c *ChunkInfo)
+		status  string
+	}{
+		{"明文", "", false, nil, "ok"},
+		{"加密", "", true, nil, "ok"},
+		{"压缩且加密", compressionGzip, true, nil, "ok"},
+		{"哈希不匹配", compressionZstd, true, func(c *ChunkInfo) { c.SHA256 = hex.EncodeToString(make([]byte, 32)) }, "mismatch"},
+		{"nonce 错误", "", true, func(c *ChunkInfo) { c.Nonce = hex.EncodeToString(make([]byte, 12)) }, "mismatch"},
+		{"未知密钥", "", true, func(c *ChunkInfo) { c.KeyID = "k0" }, "error"},
+	}
+	var chunks []ChunkInfo
+	for _, tt := range tests {
+		c := testChunk(t, tg, plain, tt.alg, tt.encrypt)
+		if tt.tamper != nil {
+			tt.tamper(&c)
+		}
+		chunks = append(chunks, c)
+	}
+	for i, h := range verifyChunks(context.Background(), chunks) {
+		if h.Status != tests[i].status {
+			t.Errorf("%s: status %q (%s), want %q", tests[i].name, h.Status, h.Error, tests[i].status)
+		}
+	}
+}
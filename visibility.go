@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Visibility 文件的下载权限
+type Visibility string
+
+const (
+	visibilityPublic  Visibility = "public"  // 任何人都可以下载，包括按路径 /d?path=
+	visibilityLink    Visibility = "link"    // 持有 /f/{public_id}、file_id 链接即可下载，按路径下载需要登录
+	visibilityPrivate Visibility = "private" // 需要登录会话、API 令牌或签名链接
+)
+
+// defaultVisibility 未单独设置可见性的文件使用的默认值（DEFAULT_VISIBILITY）
+var defaultVisibility = visibilityPublic
+
+// parseVisibility 解析可见性参数，"default" 表示恢复为默认值（返回空）
+func parseVisibility(s string) (Visibility, error) {
+	switch v := Visibility(strings.ToLower(strings.TrimSpace(s))); v {
+	case visibilityPublic, visibilityLink, visibilityPrivate:
+		return v, nil
+	case "link-only":
+		return visibilityLink, nil
+	case "default":
+		return "", nil
+	}
+	return "", fmt.Errorf("不支持的可见性: %s，可选 public、link、private", s)
+}
+
+// visibility 文件实际的可见性；rec 为 nil（不在文件目录中的 file_id）时使用默认值
+func (rec *FileRecord) visibility() Visibility {
+	if rec == nil || rec.Visibility == "" {
+		return defaultVisibility
+	}
+	return rec.Visibility
+}
+
+// uploadVisibility 读取上传时指定的 visibility 参数，未指定时返回空
+func uploadVisibility(w http.ResponseWriter, r *http.Request) (Visibility, bool) {
+	s := r.FormValue("visibility")
+	if s == "" {
+		return "", true
+	}
+	v, err := parseVisibility(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return v, true
+}
+
+// authorizeDownload 按文件的可见性检查下载权限。recs 为下载内容对应的文件记录：按路径、公开 ID 下载时只有该记录，
+// 按 file_id 下载时为共用该 file_id 的所有记录（秒传），任一记录允许即可下载；为空（不在文件目录中）时使用默认可见性。
+// linked 表示通过不可猜测的链接（公开 ID、file_id）访问；带签名的请求在此之前已经校验过签名，直接放行。
+// 私有文件只有所有者（不在目录中的文件只有管理员）可以下载
+func authorizeDownload(w http.ResponseWriter, r *http.Request, recs []*FileRecord, linked bool) bool {
+	if r.URL.Query().Get("sig") != "" {
+		return true
+	}
+	allowed := func(v Visibility) bool {
+		return v == visibilityPublic || v == visibilityLink && linked
+	}
+	if len(recs) == 0 && allowed(defaultVisibility) {
+		return true
+	}
+	for _, rec := range recs {
+		if allowed(rec.visibility()) {
+			return true
+		}
+	}
+	u, ok := authorize(w, r, permRead)
+	if !ok {
+		return false
+	}
+	if len(recs) == 0 && u.isAdmin() {
+		return true
+	}
+	for _, rec := range recs {
+		if u.owns(rec) {
+			return true
+		}
+	}
+	writeCatalogError(w, errFileNotFound)
+	return false
+}
+
+// SetFileVisibility 修改文件的可见性，v 为空表示恢复为默认值
+func (c *Catalog) SetFileVisibility(id string, v Visibility) (*FileRecord, error) {
+	rec, err := c.GetFile(id)
+	if err != nil {
+		return nil, err
+	}
+	rec.Visibility = v
+	return rec, c.PutFile(rec)
+}
+
+// applyUploadVisibility 上传命中已有文件（秒传）时，按本次指定的可见性更新文件记录
+func applyUploadVisibility(rec *FileRecord, v Visibility) *FileRecord {
+	if v == "" || rec.Visibility == v {
+		return rec
+	}
+	updated, err := catalog.SetFileVisibility(rec.ID, v)
+	if err != nil {
+		log.Printf("修改文件 [%s] 可见性失败: %v", rec.Filename, err)
+		return rec
+	}
+	return updated
+}
+
+// handleSetVisibility POST /api/files/{id}/visibility，参数 visibility（public、link、private 或 default）
+func handleSetVisibility(w http.ResponseWriter, r *http.Request) {
+	u, ok := authorize(w, r, permUpload)
+	if !ok {
+		return
+	}
+	v, err := parseVisibility(r.FormValue("visibility"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec, err := getUserFile(u, r.PathValue("id"))
+	if err == nil {
+		rec, err = catalog.SetFileVisibility(rec.ID, v)
+	}
+	if err != nil {
+		writeCatalogError(w, err)
+		return
+	}
+	writeJSON(w, u.viewFile(rec))
+}
+
+// handleVisibilityCommand 机器人命令：回复文件消息 /visibility public|link|private|default 修改可见性，不带参数时查看
+func handleVisibilityCommand(msg *tgbotapi.Message) {
+	reply := func(text string) {
+		if _, err := bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text)); err != nil {
+			log.Println(err)
+		}
+	}
+	fileID, _ := replyFile(msg.ReplyToMessage)
+	if fileID == "" {
+		reply("无法获取文件ID")
+		return
+	}
+	rec, err := catalog.GetFile(fileID)
+	if errors.Is(err, errFileNotFound) {
+		reply("文件不在文件目录中，使用默认可见性: " + string(defaultVisibility))
+		return
+	}
+	if err != nil {
+		reply("读取文件目录失败: " + err.Error())
+		return
+	}
+	arg := msg.CommandArguments()
+	if strings.TrimSpace(arg) == "" {
+		reply(fmt.Sprintf("文件 [%s] 的可见性: %s", rec.Filename, rec.visibility()))
+		return
+	}
+	v, err := parseVisibility(arg)
+	if err != nil {
+		reply(err.Error())
+		return
+	}
+	if rec, err = catalog.SetFileVisibility(rec.ID, v); err != nil {
+		reply("修改可见性失败: " + err.Error())
+		return
+	}
+	reply(fmt.Sprintf("🔒文件 [%s] 的可见性已修改为: %s", rec.Filename, rec.visibility()))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseVisibility(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Visibility
+		wantErr bool
+	}{
+		{"public", visibilityPublic, false},
+		{" Private ", visibilityPrivate, false},
+		{"link", visibilityLink, false},
+		{"link-only", visibilityLink, false},
+		{"default", "", false},
+		{"secret", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseVisibility(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseVisibility(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// 秒传的两条记录共用同一个 file_id 但可见性不同，按路径、公开 ID 下载时只按对应的记录检查权限
+func TestDownloadDedupedVisibility(t *testing.T) {
+	tg := setupTest(t)
+	fileID, messageID := tg.upload([]byte("shared content"))
+	newRecord := func(path, name string, v Visibility) *FileRecord {
+		rec := &FileRecord{FileID: fileID, MessageID: messageID, Filename: name, Size: 14, Path: path, Visibility: v}
+		if err := catalog.PutFile(rec); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/d", handleDownload)
+	mux.HandleFunc("GET /f/{id}", handlePublicDownload)
+
+	tests := []struct {
+		name   string
+		vis    [2]Visibility // 第一条、第二条记录的可见性
+		target func(a, b *FileRecord) string
+		pwd    string
+		want   int
+	}{
+		{"公开记录按路径", [2]Visibility{visibilityPublic, visibilityPrivate},
+			func(a, b *FileRecord) string { return "/d?path=" + url.QueryEscape(a.FullPath()) }, "", http.StatusOK},
+		{"私有记录按路径", [2]Visibility{visibilityPublic, visibilityPrivate},
+			func(a, b *FileRecord) string { return "/d?path=" + url.QueryEscape(b.FullPath()) }, "", http.StatusUnauthorized},
+		{"私有记录按路径登录后", [2]Visibility{visibilityPublic, visibilityPrivate},
+			func(a, b *FileRecord) string { return "/d?path=" + url.QueryEscape(b.FullPath()) }, "secret", http.StatusOK},
+		{"公开记录的公开 ID", [2]Visibility{visibilityPublic, visibilityPrivate},
+			func(a, b *FileRecord) string { return "/f/" + a.PublicID }, "", http.StatusOK},
+		{"私有记录的公开 ID", [2]Visibility{visibilityPublic, visibilityPrivate},
+			func(a, b *FileRecord) string { return "/f/" + b.PublicID }, "", http.StatusUnauthorized},
+		{"后写入的记录为私有", [2]Visibility{visibilityPrivate, visibilityPublic},
+			func(a, b *FileRecord) string { return "/d?path=" + url.QueryEscape(a.FullPath()) }, "", http.StatusUnauthorized},
+		{"共用 file_id 且有公开记录", [2]Visibility{visibilityPrivate, visibilityPublic},
+			func(a, b *FileRecord) string { return "/d?file_id=" + fileID + "&filename=a.txt" }, "", http.StatusOK},
+		{"共用 file_id 且都为私有", [2]Visibility{visibilityPrivate, visibilityPrivate},
+			func(a, b *FileRecord) string { return "/d?file_id=" + fileID + "&filename=a.txt" }, "", http.StatusUnauthorized},
+		{"按路径访问仅链接的记录", [2]Visibility{visibilityLink, visibilityPublic},
+			func(a, b *FileRecord) string { return "/d?path=" + url.QueryEscape(a.FullPath()) }, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, rec := range []string{"/a/a.txt", "/b/b.txt"} {
+				if old, err := catalog.GetFileByPath(rec); err == nil {
+					catalog.DeleteFile(old.ID)
+				}
+			}
+			a := newRecord("/a", "a.txt", tt.vis[0])
+			b := newRecord("/b", "b.txt", tt.vis[1])
+			r := httptest.NewRequest(http.MethodGet, tt.target(a, b), nil)
+			if tt.pwd != "" {
+				r.Header.Set("X-Access-Pwd", tt.pwd)
+			}
+			w := serve(mux, r)
+			if w.Code != tt.want {
+				t.Fatalf("%s: status %d, want %d: %s", tt.target(a, b), w.Code, tt.want, w.Body)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != "shared content" {
+				t.Errorf("body = %q", w.Body)
+			}
+		})
+	}
+}